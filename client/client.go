@@ -3,21 +3,61 @@
 package prc_client
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"sync"
 	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
 )
 
+// Request start ACK received from the server
+type RequestStartAck struct {
+	// Error sent by the server instead of the ACK
+	err error
+
+	// True if the limit was reached
+	limited bool
+
+	// True if the request type is frozen
+	frozen bool
+
+	// Number of requests of the type
+	count uint32
+
+	// Limit enforced by the server
+	limit uint32
+
+	// Estimated time until the type has room for a new request
+	retryAfter time.Duration
+}
+
 // Listener for request start ack
 type RequestStartAckListener struct {
 	// Channel to receive the response
-	channel chan bool
+	channel chan *RequestStartAck
 }
 
-// Listener for request count
-type RequestCountListener struct {
-	// Channel to receive the request count
-	channel chan uint32
+// Result of StartRequest
+type StartRequestResult struct {
+	// Reference to the started request. Keep it to indicate the ending. Nil if the request type reached the limit
+	Request *StartedRequest
+
+	// True if the limit was reached, so the request should be rejected
+	Limited bool
+
+	// True if the request was rejected because the request type is frozen
+	Frozen bool
+
+	// Number of requests of the type being handled, including the started one
+	Count uint32
+
+	// Limit enforced by the server
+	Limit uint32
+
+	// If limited, estimated time until the request type has room for a new request. 0 if unknown
+	RetryAfter time.Duration
 }
 
 // Client for the parallel request controller
@@ -28,11 +68,14 @@ type Client struct {
 	// Configuration
 	config *ClientConfig
 
-	// Connections
-	connections []*Connection
+	// Shards of the request types
+	shards []*Shard
 
-	// Index to balance the use of the connections
-	connectionBalancer int
+	// Hash ring to find the shard owning a request type
+	ring *HashRing
+
+	// Connections of every shard
+	connections []*Connection
 
 	// ID for the next request
 	nextRequestId uint64
@@ -40,8 +83,32 @@ type Client struct {
 	// Expecting ACKs
 	expectingRequestAck map[uint64]*RequestStartAckListener
 
-	// Expecting request counts
-	expectingRequestCount map[string]([]*RequestCountListener)
+	// Watched request types
+	watchedRequestTypes map[string]*WatchedRequestType
+
+	// ID for the next query
+	nextQueryId uint64
+
+	// Expecting query replies
+	expectingQueryReply map[uint64]*QueryReplyListener
+
+	// Limiter for the requests started while the controller is unreachable
+	localLimiter *LocalLimiter
+
+	// Permits leased from the server
+	prefetcher *PermitPrefetcher
+
+	// True if the client was closed
+	closed bool
+
+	// Channel closed when the client is closed
+	closedChan chan struct{}
+
+	// Number of established connections
+	liveConnections int
+
+	// Channel closed (and replaced) when a connection is established or lost
+	stateChanged chan struct{}
 }
 
 // Creates client
@@ -52,20 +119,35 @@ func NewClient(config *ClientConfig) *Client {
 		connectionsCount = config.NumberOfConnections
 	}
 
-	connections := make([]*Connection, connectionsCount)
+	shardConfigs := config.GetShards()
+	shardIds := make([]string, len(shardConfigs))
+
+	for i, shardConfig := range shardConfigs {
+		shardIds[i] = shardConfig.GetId()
+	}
 
 	cli := &Client{
-		mu:                    &sync.Mutex{},
-		config:                config,
-		connections:           connections,
-		connectionBalancer:    0,
-		nextRequestId:         0,
-		expectingRequestAck:   make(map[uint64]*RequestStartAckListener),
-		expectingRequestCount: make(map[string][]*RequestCountListener),
+		mu:                  &sync.Mutex{},
+		config:              config,
+		shards:              make([]*Shard, len(shardConfigs)),
+		ring:                NewHashRing(shardIds),
+		connections:         make([]*Connection, 0, len(shardConfigs)*connectionsCount),
+		nextRequestId:       0,
+		expectingRequestAck: make(map[uint64]*RequestStartAckListener),
+		watchedRequestTypes: make(map[string]*WatchedRequestType),
+		nextQueryId:         0,
+		expectingQueryReply: make(map[uint64]*QueryReplyListener),
+		localLimiter:        NewLocalLimiter(),
+		prefetcher:          NewPermitPrefetcher(),
+		closed:              false,
+		closedChan:          make(chan struct{}),
+		liveConnections:     0,
+		stateChanged:        make(chan struct{}),
 	}
 
-	for i := 0; i < len(cli.connections); i++ {
-		cli.connections[i] = NewConnection(cli, config)
+	for i, shardConfig := range shardConfigs {
+		cli.shards[i] = NewShard(cli, config, shardConfig, connectionsCount)
+		cli.connections = append(cli.connections, cli.shards[i].connections...)
 	}
 
 	return cli
@@ -73,32 +155,203 @@ func NewClient(config *ClientConfig) *Client {
 
 // Connects the client
 func (cli *Client) Connect() {
+	cli.mu.Lock()
+
+	if cli.closed {
+		cli.closed = false
+		cli.closedChan = make(chan struct{})
+	}
+
+	cli.mu.Unlock()
+
 	for _, conn := range cli.connections {
 		conn.Connect()
 	}
 }
 
 // Closes all the connections
+// Calls waiting for a response from the server will fail with ErrClosed
 func (cli *Client) Close() {
+	cli.mu.Lock()
+
+	if !cli.closed {
+		cli.closed = true
+		close(cli.closedChan)
+	}
+
+	cli.closeWatchers()
+
+	cli.mu.Unlock()
+
 	for _, conn := range cli.connections {
 		conn.Close()
 	}
 }
 
-// Gets a connection from the pool
-func (cli *Client) getConnectionFromPool() *Connection {
+// Gets a channel closed when the client is closed
+// Also returns true if the client is already closed
+func (cli *Client) getClosedChan() (closedChan <-chan struct{}, closed bool) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	return cli.closedChan, cli.closed
+}
+
+// Gets a connection from the pool of a shard
+func (cli *Client) getConnectionFromPool(shard *Shard) *Connection {
+	conn, _ := cli.getAvailableConnectionFromPool(shard)
+	return conn
+}
+
+// Gets a connection from the pool of a shard, following the configured selection strategy
+// Connections not established are skipped, unless none of them is established
+// Returns the connection, and true if it is established
+func (cli *Client) getAvailableConnectionFromPool(shard *Shard) (*Connection, bool) {
+	stats := make([]ConnectionStats, len(shard.connections))
+
+	for i, conn := range shard.connections {
+		stats[i] = conn.GetStats()
+	}
+
 	cli.mu.Lock()
 	defer cli.mu.Unlock()
 
-	conn := cli.connections[cli.connectionBalancer]
+	// Start from the next connection in order, so ties are balanced
+
+	start := shard.connectionBalancer
 
-	cli.connectionBalancer++
+	shard.connectionBalancer++
 
-	if cli.connectionBalancer >= len(cli.connections) {
-		cli.connectionBalancer = 0
+	if shard.connectionBalancer >= len(shard.connections) {
+		shard.connectionBalancer = 0
 	}
 
-	return conn
+	best := -1
+
+	for k := 0; k < len(stats); k++ {
+		i := (start + k) % len(stats)
+
+		if !stats[i].Connected {
+			continue
+		}
+
+		if best == -1 || cli.isBetterConnection(&stats[i], &stats[best]) {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return shard.connections[start], false
+	}
+
+	return shard.connections[best], true
+}
+
+// Checks if a connection is better than other, following the configured selection strategy
+func (cli *Client) isBetterConnection(stats *ConnectionStats, other *ConnectionStats) bool {
+	switch cli.config.ConnectionSelection {
+	case ConnectionSelectionRoundRobin:
+		return false
+	case ConnectionSelectionLowestLatency:
+		return stats.RoundTripTime < other.RoundTripTime
+	default:
+		return stats.Outstanding() < other.Outstanding()
+	}
+}
+
+// Checks if the policy requires to fail immediately when the controller is unreachable
+func (cli *Client) mustFailWhenUnavailable() bool {
+	return cli.config.UnavailablePolicy != UnavailablePolicyWait
+}
+
+// Starts a request locally, while the controller is unreachable, following the configured policy
+// The request is registered into the connection, so the server counts it once connected
+func (cli *Client) startLocalRequest(conn *Connection, requestType string, limit uint32, weight uint32) (result StartRequestResult, err error) {
+	var localLimiter *LocalLimiter = nil
+	count := uint32(0)
+
+	switch cli.config.UnavailablePolicy {
+	case UnavailablePolicyFailOpen:
+		// No limit
+	case UnavailablePolicyLocalFallback:
+		nodes := uint32(max(cli.config.ExpectedNodeCount, 1))
+		limit = max(limit/nodes, 1)
+
+		var started bool
+
+		started, count = cli.localLimiter.TryStartRequest(requestType, limit, weight)
+
+		if !started {
+			return StartRequestResult{
+				Limited: true,
+				Count:   count,
+				Limit:   limit,
+			}, nil
+		}
+
+		localLimiter = cli.localLimiter
+	default:
+		return StartRequestResult{}, ErrUnavailable
+	}
+
+	id := cli.getNewRequestId()
+
+	lost := conn.StartLocalRequest(id, requestType, limit, weight)
+
+	return StartRequestResult{
+		Request: &StartedRequest{
+			id:           id,
+			connection:   conn,
+			requestType:  requestType,
+			weight:       weight,
+			localLimiter: localLimiter,
+			endOnce:      &sync.Once{},
+			lost:         lost,
+		},
+		Limited: false,
+		Count:   count,
+		Limit:   limit,
+	}, nil
+}
+
+// Gets the timeout for receiving responses from the server
+func (cli *Client) getTimeout() time.Duration {
+	if cli.config.Timeout > 0 {
+		return cli.config.Timeout
+	}
+
+	return DEFAULT_TIMEOUT
+}
+
+// Applies the configured timeout to a context
+// Use contextError to get the error to return when the context finishes
+func (cli *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cli.getTimeout())
+}
+
+// Gets the error to return when a query fails
+// Returns the error itself, unless it was caused by a context created with withTimeout
+func queryError(parent context.Context, conn *Connection, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return contextError(parent, conn)
+	}
+
+	return err
+}
+
+// Gets the error to return when a context created with withTimeout finishes
+// Returns the error of the parent context if it finished, ErrNotConnected if the connection
+// was not established, or ErrTimeout otherwise
+func contextError(parent context.Context, conn *Connection) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+
+	if !conn.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return ErrTimeout
 }
 
 // Gets new unique request ID for this client
@@ -122,7 +375,8 @@ func (cli *Client) removeAckListener(id uint64) {
 }
 
 // Receives request ACK from a connection
-func (cli *Client) receiveRequestAck(id uint64, limited bool) {
+// Returns true if there was a call waiting for it
+func (cli *Client) receiveRequestAck(id uint64, ack *RequestStartAck) bool {
 	var listener *RequestStartAckListener = nil
 
 	cli.mu.Lock()
@@ -131,9 +385,16 @@ func (cli *Client) receiveRequestAck(id uint64, limited bool) {
 
 	cli.mu.Unlock()
 
-	if listener != nil {
-		listener.channel <- limited
+	if listener == nil {
+		return false
 	}
+
+	select {
+	case listener.channel <- ack:
+	default:
+	}
+
+	return true
 }
 
 // Indicates the start of a request
@@ -141,27 +402,74 @@ func (cli *Client) receiveRequestAck(id uint64, limited bool) {
 // - requestType - String to indicate the request type
 // - limit - Máximum number of requests allowed to be run in parallel
 // Returns:
-// - req - Reference to the started request. Keep it to indicate the ending. May be nil in case of error or if the request type reached the limit
-// - limited - True if the limit was reached, so the request should be rejected
+// - result - Result of the request start. If not limited, keep result.Request to indicate the ending
 // - err - An error that prevented the request start indication from completing
-func (cli *Client) StartRequest(requestType string, limit uint32) (req *StartedRequest, limited bool, err error) {
+func (cli *Client) StartRequest(requestType string, limit uint32) (result StartRequestResult, err error) {
+	return cli.StartRequestContext(context.Background(), requestType, limit)
+}
+
+// Indicates the start of a request, waiting for the server response until the context finishes
+// If the context finishes before receiving the response, the request is ended, so it does not use a slot even if the server started it
+// Parameters:
+// - ctx - Context to cancel the wait. The configured timeout also applies
+// - requestType - String to indicate the request type
+// - limit - Máximum number of requests allowed to be run in parallel
+// Returns:
+// - result - Result of the request start. If not limited, keep result.Request to indicate the ending
+// - err - An error that prevented the request start indication from completing. The context error if it finished
+func (cli *Client) StartRequestContext(ctx context.Context, requestType string, limit uint32) (result StartRequestResult, err error) {
+	startTime := time.Now()
+
+	result, err = cli.startRequest(ctx, requestType, limit, 1)
+
+	cli.reportStartRequest(requestType, result, err, time.Since(startTime))
+
+	return result, err
+}
+
+// Indicates the start of a request (internal), waiting for the server response until the context finishes
+// The request takes weight slots of the limit
+func (cli *Client) startRequest(ctx context.Context, requestType string, limit uint32, weight uint32) (result StartRequestResult, err error) {
 	if limit < 1 {
-		return nil, true, nil
+		return StartRequestResult{Limited: true}, nil
 	}
 
 	if requestType == "" {
-		return nil, false, errors.New("invalid request type")
+		return StartRequestResult{}, ErrInvalidRequestType
+	}
+
+	if err := ctx.Err(); err != nil {
+		return StartRequestResult{}, err
+	}
+
+	closedChan, closed := cli.getClosedChan()
+
+	if closed {
+		return StartRequestResult{}, ErrClosed
 	}
 
-	// Create an ID for the request, and get a connection to the PRC
+	// Get a connection to the PRC
+
+	shard := cli.getShard(requestType)
+
+	conn, available := cli.getAvailableConnectionFromPool(shard)
+
+	if !available && cli.mustFailWhenUnavailable() {
+		return cli.startLocalRequest(conn, requestType, limit, weight)
+	}
+
+	if weight == 1 && cli.mustPrefetch(requestType) {
+		return cli.startPrefetchedRequest(ctx, shard, requestType, limit)
+	}
+
+	// Create an ID for the request
 
 	id := cli.getNewRequestId()
-	conn := cli.getConnectionFromPool()
 
 	// Setup listener for the ACK
 
 	listener := &RequestStartAckListener{
-		channel: make(chan bool),
+		channel: make(chan *RequestStartAck, 1),
 	}
 
 	cli.mu.Lock()
@@ -174,76 +482,65 @@ func (cli *Client) StartRequest(requestType string, limit uint32) (req *StartedR
 
 	// Send the start message
 
-	conn.StartRequest(id, requestType, limit)
+	lost := conn.StartRequest(id, requestType, limit, weight)
 
 	// Wait
 
-	timeout := DEFAULT_TIMEOUT
-
-	if cli.config.Timeout > 0 {
-		timeout = cli.config.Timeout
-	}
+	timeoutCtx, cancel := cli.withTimeout(ctx)
+	defer cancel()
 
 	select {
-	case limited := <-listener.channel:
-		if limited {
-			return nil, true, nil
-		} else {
-			return &StartedRequest{
-				id:         id,
-				connection: conn,
-			}, false, nil
+	case ack := <-listener.channel:
+		if ack.err != nil {
+			conn.ForgetRequest(id)
+			return StartRequestResult{}, ack.err
 		}
-	case <-time.After(timeout):
-		conn.EndRequest(id)
-		return nil, false, errors.New("timeout")
-	}
-}
 
-// Receives a request count, calling the listeners
-func (cli *Client) receiveRequestCount(rType string, count uint32) {
-	var listeners []*RequestCountListener = nil
-
-	cli.mu.Lock()
-
-	listeners = cli.expectingRequestCount[rType]
-
-	delete(cli.expectingRequestCount, rType)
+		if ctx.Err() != nil {
+			// The context finished at the same time, so the caller is no longer interested
+			conn.EndRequest(id)
+			return StartRequestResult{}, ctx.Err()
+		}
 
-	cli.mu.Unlock()
+		result = StartRequestResult{
+			Request:    nil,
+			Limited:    ack.limited,
+			Frozen:     ack.frozen,
+			Count:      ack.count,
+			Limit:      ack.limit,
+			RetryAfter: ack.retryAfter,
+		}
 
-	if listeners == nil {
-		return
-	}
+		if ack.limited {
+			conn.ForgetRequest(id)
+		} else {
+			result.Request = &StartedRequest{
+				id:           id,
+				connection:   conn,
+				requestType:  requestType,
+				weight:       weight,
+				localLimiter: nil,
+				endOnce:      &sync.Once{},
+				lost:         lost,
+			}
+		}
 
-	for _, lis := range listeners {
-		lis.channel <- count
+		return result, nil
+	case <-timeoutCtx.Done():
+		// Ending the request releases the slot in case the server started it
+		conn.EndRequest(id)
+		return StartRequestResult{}, contextError(ctx, conn)
+	case <-closedChan:
+		return StartRequestResult{}, ErrClosed
 	}
 }
 
-// Clears request count listener on timeout
-func (cli *Client) clearRequestCountListener(rType string, listener *RequestCountListener) {
+// Receives a request count notification for a watched request type
+func (cli *Client) receiveRequestCount(rType string, count uint32) {
 	cli.mu.Lock()
+	defer cli.mu.Unlock()
 
-	listeners := cli.expectingRequestCount[rType]
-
-	if listeners != nil {
-		newListeners := make([]*RequestCountListener, 0)
-
-		for _, lis := range listeners {
-			if lis != listener {
-				newListeners = append(newListeners, lis)
-			}
-		}
-
-		if len(newListeners) > 0 {
-			cli.expectingRequestCount[rType] = newListeners
-		} else {
-			delete(cli.expectingRequestCount, rType)
-		}
-	}
-
-	cli.mu.Unlock()
+	cli.notifyWatchers(rType, count)
 }
 
 // Gets the current number of parallel requests of a type
@@ -253,50 +550,49 @@ func (cli *Client) clearRequestCountListener(rType string, listener *RequestCoun
 // - count - Current number of parallel requests of the specified type
 // - err - An error that prevented the request count from completing
 func (cli *Client) GetRequestCount(requestType string) (count uint32, err error) {
+	return cli.GetRequestCountContext(context.Background(), requestType)
+}
+
+// Gets the current number of parallel requests of a type, waiting for the server response until the context finishes
+// Parameters:
+// - ctx - Context to cancel the wait. The configured timeout also applies
+// - requestType - String to indicate the request type
+// Returns:
+// - count - Current number of parallel requests of the specified type
+// - err - An error that prevented the request count from completing. The context error if it finished
+func (cli *Client) GetRequestCountContext(ctx context.Context, requestType string) (count uint32, err error) {
 	if requestType == "" {
-		return 0, errors.New("invalid request type")
+		return 0, ErrInvalidRequestType
 	}
 
 	// Get a connection
 
-	conn := cli.getConnectionFromPool()
+	conn, _ := cli.getAvailableConnectionFromPool(cli.getShard(requestType))
 
-	// Setup listener for the ACK
+	// Send the query and wait
 
-	listener := &RequestCountListener{
-		channel: make(chan uint32),
+	msg := &simple_rpc_message.RPCMessage{
+		Method: "GET-REQUEST-COUNT",
+		Params: map[string]string{
+			"Request-Type": requestType,
+		},
+		Body: "",
 	}
 
-	cli.mu.Lock()
+	timeoutCtx, cancel := cli.withTimeout(ctx)
+	defer cancel()
 
-	a := cli.expectingRequestCount[requestType]
+	reply, err := cli.sendQuery(timeoutCtx, conn, msg)
 
-	if a == nil {
-		cli.expectingRequestCount[requestType] = []*RequestCountListener{listener}
-	} else {
-		cli.expectingRequestCount[requestType] = append(a, listener)
+	if err != nil {
+		return 0, queryError(ctx, conn, err)
 	}
 
-	cli.mu.Unlock()
-
-	// Send message
-
-	conn.GetRequestCount(requestType)
-	defer conn.RequestCountDone(requestType)
-
-	// Wait
-
-	timeout := DEFAULT_TIMEOUT
+	c, err := strconv.ParseUint(reply.GetParam("Request-Count"), 10, 32)
 
-	if cli.config.Timeout > 0 {
-		timeout = cli.config.Timeout
+	if err != nil {
+		return 0, ErrInvalidResponse
 	}
 
-	select {
-	case count := <-listener.channel:
-		return count, nil
-	case <-time.After(timeout):
-		cli.clearRequestCountListener(requestType, listener)
-		return 0, errors.New("timeout")
-	}
+	return uint32(c), nil
 }
@@ -3,22 +3,30 @@
 package prc_client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/joho/godotenv"
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+	"github.com/AgustinSRG/parallel-request-controller/client/internal/testserver"
 	"github.com/stretchr/testify/assert"
 )
 
-func getEnvString(key string, defaultVal string) string {
-	v := os.Getenv(key)
+// Server used by the tests
+var testServer *testserver.Server
 
-	if v == "" {
-		v = defaultVal
-	}
+func TestMain(m *testing.M) {
+	testServer = testserver.NewServer()
+
+	code := m.Run()
 
-	return v
+	testServer.Close()
+
+	os.Exit(code)
 }
 
 type testErrorHandler struct {
@@ -36,27 +44,25 @@ func (th *testErrorHandler) OnServerError(code string, message string) {
 func testStartRequest(t *testing.T, wg *sync.WaitGroup, startedRequestsArray []*StartedRequest, limitedArray []bool, index int, cli *Client, rType string, limit uint32) {
 	defer wg.Done()
 
-	r, limited, err := cli.StartRequest(rType, limit)
+	res, err := cli.StartRequest(rType, limit)
 
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	limitedArray[index] = limited
-	startedRequestsArray[index] = r
+	limitedArray[index] = res.Limited
+	startedRequestsArray[index] = res.Request
 }
 
 func TestClient(t *testing.T) {
-	godotenv.Load() // Load env vars
-
 	th := &testErrorHandler{
 		t: t,
 	}
 
 	cli := NewClient(&ClientConfig{
-		Url:          getEnvString("SERVER_URL", "ws://localhost:8080"),
-		AuthToken:    getEnvString("AUTH_TOKEN", "change_me"),
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
 		ErrorHandler: th,
 	})
 
@@ -157,3 +163,1798 @@ func TestClient(t *testing.T) {
 
 	cli.Close()
 }
+
+func waitForWatchedCount(t *testing.T, updates <-chan uint32, expected uint32) {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case count, ok := <-updates:
+			if !ok {
+				t.Error("Watch channel closed")
+				return
+			}
+
+			if count == expected {
+				return
+			}
+		case <-timeout:
+			t.Errorf("Timed out waiting for count %d", expected)
+			return
+		}
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-watch-type"
+
+	updates, cancel := cli.Watch(rType)
+
+	waitForWatchedCount(t, updates, 0)
+
+	// A second watcher of the same type
+
+	updates2, cancel2 := cli.Watch(rType)
+
+	waitForWatchedCount(t, updates2, 0)
+
+	cancel2()
+
+	// Start and end a request
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	sr := res.Request
+
+	waitForWatchedCount(t, updates, 1)
+
+	sr.End()
+
+	waitForWatchedCount(t, updates, 0)
+
+	// Cancel
+
+	cancel()
+
+	for range updates {
+	}
+
+	// Closing the client closes the channels
+
+	updates3, cancel3 := cli.Watch(rType)
+
+	waitForWatchedCount(t, updates3, 0)
+
+	cli.Close()
+
+	for range updates3 {
+	}
+
+	cancel3()
+}
+
+func TestClientDrain(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-drain-type"
+
+	res, err := cli.StartRequest(rType, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	sr := res.Request
+
+	// Freeze
+
+	err = cli.Freeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res, err = cli.StartRequest(rType, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res.Limited)
+	assert.True(t, res.Frozen)
+
+	// Wait with a request in progress
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err = cli.WaitDrained(ctx, rType)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Cancel a wait with no deadline
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel2()
+	}()
+
+	err = cli.WaitDrained(ctx2, rType)
+
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// End the request and wait
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sr.End()
+	}()
+
+	err = cli.WaitDrained(context.Background(), rType)
+
+	assert.NoError(t, err)
+
+	// Unfreeze
+
+	err = cli.Unfreeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res, err = cli.StartRequest(rType, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	res.Request.End()
+
+	// Freeze by prefix
+
+	err = cli.FreezePrefix("test-drain-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res, err = cli.StartRequest(rType, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res.Limited)
+
+	err = cli.UnfreezePrefix("test-drain-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cli.Close()
+}
+
+func waitForFrozen(t *testing.T, server *testserver.Server, rType string, expected bool) {
+	timeout := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(timeout) {
+		if server.RequestController().IsFrozen(rType) == expected {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Timed out waiting for frozen = %v", expected)
+}
+
+func TestClientFreezeOwnership(t *testing.T) {
+	server := testserver.NewServer()
+	defer server.Close()
+
+	eh := &testEventHandler{
+		events: make(chan string, 10),
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  server.Url(),
+		AuthToken:            server.AuthToken(),
+		EventHandler:         eh,
+		RetryConnectionDelay: 100 * time.Millisecond,
+	})
+
+	cli.Connect()
+
+	waitForEvent(t, eh, "connected")
+
+	rType := "test-freeze-ownership-type"
+
+	err := cli.Freeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, server.RequestController().IsFrozen(rType))
+
+	// The server keeps the freeze while the client reconnects, and the client resumes it
+
+	server.DropConnections()
+
+	waitForEvent(t, eh, "lost")
+
+	assert.True(t, server.RequestController().IsFrozen(rType))
+
+	waitForEvent(t, eh, "reconnected")
+
+	waitForFrozen(t, server, rType, true)
+
+	// Freezes removed by others are not made again on connection
+
+	server.RequestController().Unfreeze(rType)
+
+	server.DropConnections()
+
+	waitForEvent(t, eh, "lost")
+	waitForEvent(t, eh, "reconnected")
+
+	assert.Eventually(t, func() bool {
+		cli.connections[0].mu.Lock()
+		defer cli.connections[0].mu.Unlock()
+
+		return len(cli.connections[0].freezes) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.False(t, server.RequestController().IsFrozen(rType))
+
+	// Closing the client removes the freeze, and it is not made again when connecting
+
+	err = cli.Freeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cli.Close()
+
+	waitForEvent(t, eh, "disconnected")
+	waitForFrozen(t, server, rType, false)
+
+	cli.Connect()
+
+	waitForEvent(t, eh, "connected")
+
+	_, err = cli.GetRequestCount(rType) // Wait for the connection messages to be handled
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, server.RequestController().IsFrozen(rType))
+
+	cli.Close()
+}
+
+func TestClientFreezePrefixRollback(t *testing.T) {
+	serverA := testserver.NewServer()
+	defer serverA.Close()
+
+	serverB := testserver.NewServer()
+	defer serverB.Close()
+
+	serverB.SetFault("FREEZE", "INTERNAL_ERROR", "Test error")
+
+	cli := NewClient(&ClientConfig{
+		Shards: []ShardConfig{
+			{Id: "shard-a", Urls: []string{serverA.Url()}},
+			{Id: "shard-b", Urls: []string{serverB.Url()}},
+		},
+		AuthToken: serverA.AuthToken(),
+	})
+
+	cli.Connect()
+
+	prefix := "test-freeze-rollback-"
+
+	// The prefix is frozen in the first shard, and then the second one fails
+
+	err := cli.FreezePrefix(prefix)
+
+	assert.Error(t, err)
+
+	// The freeze of the first shard is removed
+
+	waitForFrozen(t, serverA, prefix+"a", false)
+
+	for _, conn := range cli.connections {
+		conn.mu.Lock()
+		assert.Equal(t, len(conn.freezes), 0)
+		conn.mu.Unlock()
+	}
+
+	cli.Close()
+}
+
+func TestClientConcurrentRequestCounts(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                 testServer.Url(),
+		AuthToken:           testServer.AuthToken(),
+		NumberOfConnections: 2,
+		ErrorHandler:        th,
+	})
+
+	cli.Connect()
+
+	rType := "test-count-type"
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	sr := res.Request
+
+	// Every caller gets its own answer
+
+	counts := make([]uint32, 10)
+	wg := &sync.WaitGroup{}
+
+	for i := range counts {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			count, err := cli.GetRequestCount(rType)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			counts[i] = count
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, count := range counts {
+		assert.Equal(t, count, uint32(1))
+	}
+
+	sr.End()
+
+	cli.Close()
+}
+
+func TestClientRequestCounts(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	startedRequests := make([]*StartedRequest, 0)
+
+	for _, rType := range []string{"test-counts:a", "test-counts:b", "test-counts:b", "test-counts:c"} {
+		res, err := cli.StartRequest(rType, 10)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+
+		startedRequests = append(startedRequests, res.Request)
+	}
+
+	// Multiple types
+
+	counts, err := cli.GetRequestCounts("test-counts:a", "test-counts:b", "test-counts:d")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, counts, map[string]uint32{
+		"test-counts:a": 1,
+		"test-counts:b": 2,
+		"test-counts:d": 0,
+	})
+
+	// Prefix
+
+	counts, err = cli.ListRequestCounts("test-counts:")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, counts, map[string]uint32{
+		"test-counts:a": 1,
+		"test-counts:b": 2,
+		"test-counts:c": 1,
+	})
+
+	for _, sr := range startedRequests {
+		sr.End()
+	}
+
+	cli.Close()
+}
+
+func TestClientStartRequestResult(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-result-type"
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+	assert.Equal(t, res.Count, uint32(1))
+	assert.Equal(t, res.Limit, uint32(1))
+
+	// End a request, so the server knows the duration
+
+	time.Sleep(100 * time.Millisecond)
+
+	res.Request.End()
+
+	res, err = cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	// Limited
+
+	res2, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res2.Limited)
+	assert.Nil(t, res2.Request)
+	assert.Equal(t, res2.Count, uint32(1))
+	assert.Equal(t, res2.Limit, uint32(1))
+	assert.Greater(t, res2.RetryAfter, time.Duration(0))
+
+	res.Request.End()
+
+	cli.Close()
+}
+
+func TestClientContext(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	rType := "test-context-type"
+
+	// Cancelled context
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cli.StartRequestContext(ctx, rType, 1)
+
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Deadline reached before connecting: the request must not be started after connecting
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = cli.StartRequestContext(ctx, rType, 1)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = cli.GetRequestCountContext(ctx, rType)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	cli.Connect()
+
+	count, err := cli.GetRequestCountContext(context.Background(), rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, count, uint32(0))
+
+	// Not cancelled
+
+	res, err := cli.StartRequestContext(context.Background(), rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	res.Request.End()
+
+	cli.Close()
+}
+
+func TestClientUnavailablePolicies(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	rType := "test-unavailable-type"
+
+	// Fail fast
+
+	cli := NewClient(&ClientConfig{
+		Url:               testServer.Url(),
+		AuthToken:         testServer.AuthToken(),
+		ErrorHandler:      th,
+		UnavailablePolicy: UnavailablePolicyFailFast,
+	})
+
+	_, err := cli.StartRequest(rType, 1)
+
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	_, err = cli.GetRequestCount(rType)
+
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// Fail open
+
+	cli = NewClient(&ClientConfig{
+		Url:               testServer.Url(),
+		AuthToken:         testServer.AuthToken(),
+		ErrorHandler:      th,
+		UnavailablePolicy: UnavailablePolicyFailOpen,
+	})
+
+	for i := 0; i < 3; i++ {
+		res, err := cli.StartRequest(rType, 1)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+
+		res.Request.End()
+	}
+
+	// Local fallback
+
+	cli = NewClient(&ClientConfig{
+		Url:               testServer.Url(),
+		AuthToken:         testServer.AuthToken(),
+		ErrorHandler:      th,
+		UnavailablePolicy: UnavailablePolicyLocalFallback,
+		ExpectedNodeCount: 2,
+	})
+
+	startedRequests := make([]*StartedRequest, 0)
+
+	for i := 0; i < 3; i++ {
+		res, err := cli.StartRequest(rType, 4)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.Equal(t, res.Limit, uint32(2))
+
+		if i < 2 {
+			assert.False(t, res.Limited)
+			startedRequests = append(startedRequests, res.Request)
+		} else {
+			assert.True(t, res.Limited)
+		}
+	}
+
+	// The local requests are counted once connected
+
+	cli.Connect()
+
+	checker := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	checker.Connect()
+
+	waitForRequestCount(t, checker, rType, 2)
+
+	for _, sr := range startedRequests {
+		sr.End()
+	}
+
+	waitForRequestCount(t, checker, rType, 0)
+
+	// Connected, so the server limit applies
+
+	res, err := cli.StartRequest(rType, 4)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, res.Limit, uint32(4))
+
+	res.Request.End()
+
+	checker.Close()
+	cli.Close()
+}
+
+func TestClientLocalRequestsLimited(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	rType := "test-local-limited-type"
+
+	// The limit is reached in the server while the client is not connected
+
+	checker := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	checker.Connect()
+
+	held := make([]*StartedRequest, 0)
+
+	for i := 0; i < 2; i++ {
+		res, err := checker.StartRequest(rType, 2)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+
+		held = append(held, res.Request)
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:               testServer.Url(),
+		AuthToken:         testServer.AuthToken(),
+		ErrorHandler:      th,
+		UnavailablePolicy: UnavailablePolicyLocalFallback,
+	})
+
+	res, err := cli.StartRequest(rType, 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	// Once connected, the server (not accepting forced requests) limits it, so it is lost
+
+	cli.Connect()
+
+	select {
+	case <-res.Request.Lost():
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the request to be lost")
+	}
+
+	waitForRequestCount(t, checker, rType, 2)
+
+	// Not sent again on connection
+
+	conn := res.Request.connection
+
+	conn.mu.Lock()
+	assert.Equal(t, len(conn.pendingRequests), 0)
+	conn.mu.Unlock()
+
+	for _, sr := range held {
+		sr.End()
+	}
+
+	waitForRequestCount(t, checker, rType, 0)
+
+	res.Request.End()
+
+	checker.Close()
+	cli.Close()
+}
+
+func TestClientErrors(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+		Timeout:      100 * time.Millisecond,
+	})
+
+	// Invalid request type
+
+	_, err := cli.StartRequest("", 1)
+
+	assert.ErrorIs(t, err, ErrInvalidRequestType)
+
+	_, err = cli.GetRequestCount("")
+
+	assert.ErrorIs(t, err, ErrInvalidRequestType)
+
+	// Timeout before connecting
+
+	_, err = cli.GetRequestCount("test-errors-type")
+
+	assert.ErrorIs(t, err, ErrNotConnected)
+
+	cli.Connect()
+
+	// Server errors are returned by the call waiting for the response
+
+	conn := cli.getConnectionFromPool(cli.shards[0])
+
+	_, err = cli.sendQuery(context.Background(), conn, &simple_rpc_message.RPCMessage{
+		Method: "GET-REQUEST-COUNT",
+		Params: map[string]string{},
+	})
+
+	var serverError *ServerError
+
+	if assert.ErrorAs(t, err, &serverError) {
+		assert.Equal(t, serverError.Code, "PROTOCOL_ERROR")
+	}
+
+	// Closed client
+
+	cli.Close()
+
+	_, err = cli.StartRequest("test-errors-type", 1)
+
+	assert.ErrorIs(t, err, ErrClosed)
+
+	_, err = cli.GetRequestCount("test-errors-type")
+
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+type testEventHandler struct {
+	events chan string
+}
+
+func (th *testEventHandler) OnConnected(event ConnectionEvent) {
+	th.events <- "connected"
+}
+
+func (th *testEventHandler) OnDisconnected(event ConnectionEvent) {
+	if event.Err != nil {
+		th.events <- "lost"
+	} else {
+		th.events <- "disconnected"
+	}
+}
+
+func (th *testEventHandler) OnReconnected(event ConnectionEvent) {
+	th.events <- "reconnected"
+}
+
+func waitForEvent(t *testing.T, th *testEventHandler, expected string) {
+	select {
+	case event := <-th.events:
+		assert.Equal(t, event, expected)
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for event: " + expected)
+	}
+}
+
+func TestClientConnectionEvents(t *testing.T) {
+	eh := &testEventHandler{
+		events: make(chan string, 10),
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		EventHandler:         eh,
+		RetryConnectionDelay: 100 * time.Millisecond,
+	})
+
+	assert.Equal(t, cli.State(), ClientStateDisconnected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, cli.WaitUntilConnected(ctx), context.DeadlineExceeded)
+
+	cli.Connect()
+
+	err := cli.WaitUntilConnected(context.Background())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, cli.State(), ClientStateConnected)
+
+	waitForEvent(t, eh, "connected")
+
+	// Drop the connection
+
+	conn := cli.connections[0]
+
+	conn.mu.Lock()
+	conn.socket.Close()
+	conn.mu.Unlock()
+
+	waitForEvent(t, eh, "lost")
+	waitForEvent(t, eh, "reconnected")
+
+	assert.Equal(t, cli.State(), ClientStateConnected)
+
+	// Close
+
+	cli.Close()
+
+	waitForEvent(t, eh, "disconnected")
+
+	assert.Equal(t, cli.State(), ClientStateDisconnected)
+
+	assert.ErrorIs(t, cli.WaitUntilConnected(context.Background()), ErrClosed)
+}
+
+func TestClientFailover(t *testing.T) {
+	eh := &testEventHandler{
+		events: make(chan string, 10),
+	}
+
+	serverUrl := testServer.Url()
+
+	cli := NewClient(&ClientConfig{
+		Urls:                 []string{"ws://localhost:1", serverUrl},
+		AuthToken:            testServer.AuthToken(),
+		EventHandler:         eh,
+		RetryConnectionDelay: 100 * time.Millisecond,
+	})
+
+	cli.Connect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := cli.WaitUntilConnected(ctx)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	waitForEvent(t, eh, "connected")
+
+	cli.connections[0].mu.Lock()
+	assert.Equal(t, cli.connections[0].endpoint, serverUrl)
+	cli.connections[0].mu.Unlock()
+
+	res, err := cli.StartRequest("test-failover-type", 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	res.Request.End()
+
+	cli.Close()
+}
+
+func TestClientSharding(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	serverUrl := testServer.Url()
+
+	// Both shards use the same server, in order to test the routing
+
+	cli := NewClient(&ClientConfig{
+		Shards: []ShardConfig{
+			{Id: "shard-a", Urls: []string{serverUrl}},
+			{Id: "shard-b", Urls: []string{serverUrl}},
+		},
+		NumberOfConnections: 2,
+		AuthToken:           testServer.AuthToken(),
+		ErrorHandler:        th,
+	})
+
+	assert.Equal(t, len(cli.connections), 4)
+
+	// Find a request type for each shard
+
+	typesByShard := make(map[string]string)
+
+	for i := 0; len(typesByShard) < 2; i++ {
+		rType := "test-sharding-type-" + fmt.Sprint(i)
+		shard := cli.getShard(rType)
+
+		if typesByShard[shard.id] == "" {
+			typesByShard[shard.id] = rType
+		}
+	}
+
+	cli.Connect()
+
+	for shardId, rType := range typesByShard {
+		res, err := cli.StartRequest(rType, 1)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+		assert.Equal(t, res.Request.connection.shard.id, shardId)
+
+		count, err := cli.GetRequestCount(rType)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.Equal(t, count, uint32(1))
+	}
+
+	counts, err := cli.GetRequestCounts(typesByShard["shard-a"], typesByShard["shard-b"])
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, counts, map[string]uint32{
+		typesByShard["shard-a"]: 1,
+		typesByShard["shard-b"]: 1,
+	})
+
+	counts, err = cli.ListRequestCounts("test-sharding-type-")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, len(counts), 2)
+
+	cli.Close()
+}
+
+func TestClientConnectionSelection(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	serverUrl := testServer.Url()
+
+	cli := NewClient(&ClientConfig{
+		Url:                 serverUrl,
+		NumberOfConnections: 3,
+		AuthToken:           testServer.AuthToken(),
+		ErrorHandler:        th,
+	})
+
+	cli.Connect()
+
+	// Wait for every connection
+
+	for i := 0; i < 100; i++ {
+		connected := 0
+
+		for _, stats := range cli.ConnectionStats() {
+			if stats.Connected {
+				connected++
+			}
+		}
+
+		if connected == 3 {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for _, stats := range cli.ConnectionStats() {
+		assert.True(t, stats.Connected)
+		assert.Equal(t, stats.Url, serverUrl)
+	}
+
+	// The round trip time is measured
+
+	rType := "test-selection-type"
+
+	for i := 0; i < 3; i++ {
+		_, err := cli.GetRequestCount(rType)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, stats := range cli.ConnectionStats() {
+		assert.Greater(t, stats.RoundTripTime, time.Duration(0))
+		assert.Equal(t, stats.Outstanding(), 0)
+	}
+
+	// Connections with outstanding messages are avoided
+
+	busyConn := cli.connections[0]
+
+	busyConn.mu.Lock()
+	busyConn.awaitingAck[1<<62] = time.Now()
+	busyConn.mu.Unlock()
+
+	shard := cli.getShard(rType)
+
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(t, cli.getConnectionFromPool(shard), busyConn)
+	}
+
+	busyConn.ForgetRequest(1 << 62)
+
+	// Connections not established are skipped
+
+	closedConn := cli.connections[1]
+	closedConn.Close()
+
+	startedRequests := make([]*StartedRequest, 0)
+
+	for i := 0; i < 6; i++ {
+		res, err := cli.StartRequest(rType, 10)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.NotEqual(t, res.Request.connection, closedConn)
+
+		startedRequests = append(startedRequests, res.Request)
+	}
+
+	for _, sr := range startedRequests {
+		sr.End()
+	}
+
+	cli.Close()
+}
+
+type testMetricsHandler struct {
+	mu       *sync.Mutex
+	outcomes map[string]int
+	inFlight map[string]int
+}
+
+func (mh *testMetricsHandler) OnStartRequest(requestType string, outcome StartRequestOutcome, latency time.Duration) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	mh.outcomes[requestType+":"+outcome.String()]++
+
+	if outcome == StartRequestAcquired {
+		mh.inFlight[requestType]++
+	}
+}
+
+func (mh *testMetricsHandler) OnRequestEnded(requestType string) {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	mh.inFlight[requestType]--
+}
+
+func (mh *testMetricsHandler) OnReconnected(shardId string) {
+}
+
+func TestClientMetrics(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	mh := &testMetricsHandler{
+		mu:       &sync.Mutex{},
+		outcomes: make(map[string]int),
+		inFlight: make(map[string]int),
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:            testServer.Url(),
+		AuthToken:      testServer.AuthToken(),
+		ErrorHandler:   th,
+		MetricsHandler: mh,
+		MetricsTypeNormalizer: func(requestType string) string {
+			return "test-metrics-type"
+		},
+	})
+
+	cli.Connect()
+
+	res1, err := cli.StartRequest("test-metrics-type-1", 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res2, err := cli.StartRequest("test-metrics-type-1", 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res2.Limited)
+
+	_, err = cli.StartRequest("", 1)
+
+	assert.Error(t, err)
+
+	mh.mu.Lock()
+	assert.Equal(t, mh.outcomes, map[string]int{
+		"test-metrics-type:acquired": 1,
+		"test-metrics-type:limited":  1,
+		"test-metrics-type:error":    1,
+	})
+	assert.Equal(t, mh.inFlight["test-metrics-type"], 1)
+	mh.mu.Unlock()
+
+	res1.Request.End()
+
+	mh.mu.Lock()
+	assert.Equal(t, mh.inFlight["test-metrics-type"], 0)
+	mh.mu.Unlock()
+
+	cli.Close()
+}
+
+func TestClientStartedRequest(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		ErrorHandler:         th,
+		RetryConnectionDelay: 100 * time.Millisecond,
+	})
+
+	cli.Connect()
+
+	rType := "test-started-request-type"
+
+	// End is idempotent
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res.Request.End()
+	res.Request.EndWithOutcome(false)
+	res.Request.End()
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	res, err = cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	res.Request.EndWithOutcome(true)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// The slot is lost when the connection drops
+
+	res, err = cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-res.Request.Lost():
+		t.Error("Request lost before the connection dropped")
+	default:
+	}
+
+	conn := res.Request.connection
+	epoch := conn.Epoch()
+
+	conn.mu.Lock()
+	conn.socket.Close()
+	conn.mu.Unlock()
+
+	select {
+	case <-res.Request.Lost():
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the request to be lost")
+	}
+
+	// Replies received before the drop are told apart, even after reconnecting
+
+	assert.Equal(t, epoch+1, conn.Epoch())
+
+	// The lost request is not sent again on reconnection
+
+	err = cli.WaitUntilConnected(context.Background())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	res.Request.End()
+
+	cli.Close()
+}
+
+func TestClientDo(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		ErrorHandler:         th,
+		RetryConnectionDelay: 100 * time.Millisecond,
+	})
+
+	cli.Connect()
+
+	rType := "test-do-type"
+
+	// Acquired: the error of the function is returned
+
+	fnError := errors.New("test error")
+
+	err := cli.Do(context.Background(), rType, 1, func(ctx context.Context) error {
+		count, err := cli.GetRequestCount(rType)
+
+		assert.NoError(t, err)
+		assert.Equal(t, count, uint32(1))
+
+		// Limited
+
+		err = cli.Do(context.Background(), rType, 1, func(ctx context.Context) error {
+			t.Error("The function must not be called when limited")
+			return nil
+		})
+
+		assert.ErrorIs(t, err, ErrLimited)
+
+		var limitedError *LimitedError
+
+		if assert.ErrorAs(t, err, &limitedError) {
+			assert.Equal(t, limitedError.Count, uint32(1))
+			assert.Equal(t, limitedError.Limit, uint32(1))
+		}
+
+		return fnError
+	})
+
+	assert.ErrorIs(t, err, fnError)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Panic: the request is ended and the panic re-raised
+
+	assert.PanicsWithValue(t, "test panic", func() {
+		cli.Do(context.Background(), rType, 1, func(ctx context.Context) error {
+			panic("test panic")
+		})
+	})
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Lost slot: the context of the function is cancelled
+
+	err = cli.Do(context.Background(), rType, 1, func(ctx context.Context) error {
+		conn := cli.connections[0]
+
+		conn.mu.Lock()
+		conn.socket.Close()
+		conn.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			assert.ErrorIs(t, context.Cause(ctx), ErrLost)
+		case <-time.After(5 * time.Second):
+			t.Error("Timed out waiting for the context to be cancelled")
+		}
+
+		return ctx.Err()
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+
+	cli.Close()
+}
+
+func TestClientPrefetch(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	rType := "test-prefetch-type"
+	limit := uint32(5)
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		ErrorHandler:         th,
+		RetryConnectionDelay: 100 * time.Millisecond,
+		PrefetchPermits:      3,
+		PrefetchRequestTypes: []string{rType},
+		PrefetchIdleTimeout:  200 * time.Millisecond,
+	})
+
+	checker := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+	checker.Connect()
+
+	// The first request leases a block of permits
+
+	startedRequests := make([]*StartedRequest, 0)
+
+	for i := 0; i < 3; i++ {
+		res, err := cli.StartRequest(rType, limit)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+
+		startedRequests = append(startedRequests, res.Request)
+
+		waitForRequestCount(t, checker, rType, 3)
+	}
+
+	// The next block is limited by the room left
+
+	res, err := cli.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	startedRequests = append(startedRequests, res.Request)
+
+	waitForRequestCount(t, checker, rType, 5)
+
+	// The leased permits count for the limit
+
+	res, err = checker.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res.Limited)
+
+	// The permits are returned after the idle timeout
+
+	for _, sr := range startedRequests {
+		sr.End()
+	}
+
+	waitForRequestCount(t, checker, rType, 0)
+
+	// The permits are lost if the connection drops
+
+	res, err = cli.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	waitForRequestCount(t, checker, rType, 3)
+
+	conn := res.Request.connection
+	epoch := conn.Epoch()
+
+	conn.mu.Lock()
+	conn.socket.Close()
+	conn.mu.Unlock()
+
+	select {
+	case <-res.Request.Lost():
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the request to be lost")
+	}
+
+	// Replies received before the drop are told apart, even after reconnecting
+
+	assert.Equal(t, epoch+1, conn.Epoch())
+
+	waitForRequestCount(t, checker, rType, 0)
+
+	res.Request.End()
+
+	// The permits of a reply delivered when the wait is abandoned are returned
+
+	assert.Eventually(t, conn.IsConnected, 5*time.Second, 10*time.Millisecond)
+
+	queryId := cli.getNewQueryId()
+
+	listener := &QueryReplyListener{
+		channel: make(chan *QueryReply, 1),
+	}
+
+	cli.mu.Lock()
+	cli.expectingQueryReply[queryId] = listener
+	cli.mu.Unlock()
+
+	conn.SendQuery(queryId, &simple_rpc_message.RPCMessage{
+		Method: "LEASE-PERMITS",
+		Params: map[string]string{
+			"Query-ID":      fmt.Sprint(queryId),
+			"Request-Type":  rType,
+			"Request-Limit": fmt.Sprint(limit),
+			"Permits":       "3",
+		},
+	})
+
+	select {
+	case reply := <-listener.channel:
+		// Delivered again, as if received right before abandoning the wait
+		listener.channel <- reply
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the lease")
+	}
+
+	waitForRequestCount(t, checker, rType, 3)
+
+	cli.abandonQuery(conn, queryId, listener)
+
+	waitForRequestCount(t, checker, rType, 0)
+
+	cli.Close()
+	checker.Close()
+}
+
+func TestClientPrefetchFreeze(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	rType := "test-prefetch-freeze-type"
+	limit := uint32(5)
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		ErrorHandler:         th,
+		PrefetchPermits:      3,
+		PrefetchRequestTypes: []string{rType},
+		PrefetchIdleTimeout:  time.Minute,
+	})
+
+	checker := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+	checker.Connect()
+
+	res, err := cli.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	waitForRequestCount(t, checker, rType, 3)
+
+	// Freezing the type revokes the permits, so the available ones are returned
+
+	err = checker.Freeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	waitForRequestCount(t, checker, rType, 1)
+
+	res2, err := cli.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res2.Limited)
+	assert.True(t, res2.Frozen)
+
+	// The permits in use are returned once their requests end, so the type drains
+
+	res.Request.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = checker.WaitDrained(ctx, rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = checker.Unfreeze(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// After unfreezing, permits are leased again
+
+	res, err = cli.StartRequest(rType, limit)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+
+	waitForRequestCount(t, checker, rType, 3)
+
+	// A smaller limit is not exceeded by the available permits
+
+	res2, err = cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res2.Limited)
+
+	waitForRequestCount(t, checker, rType, 1)
+
+	res.Request.End()
+
+	cli.Close()
+	checker.Close()
+}
+
+func TestClientStartRequestByName(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	limits, err := NewLimitRegistry(LimitsConfig{
+		Rules: []LimitRule{
+			{Pattern: "test-by-name-*", Limit: 3, Weight: 2},
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  testServer.Url(),
+		AuthToken:            testServer.AuthToken(),
+		ErrorHandler:         th,
+		RetryConnectionDelay: 100 * time.Millisecond,
+		Limits:               limits,
+	})
+
+	cli.Connect()
+
+	rType := "test-by-name-type"
+
+	// Each request takes the slots of its weight
+
+	res, err := cli.StartRequestByName(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+	assert.Equal(t, res.Count, uint32(2))
+
+	res2, err := cli.StartRequestByName(rType)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.True(t, res2.Limited)
+
+	res.Request.End()
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Reloaded limits apply to the next requests
+
+	err = limits.Update(LimitsConfig{
+		Rules: []LimitRule{
+			{Pattern: "test-by-name-*", Limit: 2},
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	startedRequests := make([]*StartedRequest, 0)
+
+	for i := 0; i < 2; i++ {
+		res, err = cli.StartRequestByName(rType)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert.False(t, res.Limited)
+
+		startedRequests = append(startedRequests, res.Request)
+	}
+
+	for _, sr := range startedRequests {
+		sr.End()
+	}
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Unknown types
+
+	_, err = cli.StartRequestByName("test-unknown-type")
+
+	assert.ErrorIs(t, err, ErrUnknownRequestType)
+
+	cli.Close()
+}
@@ -3,36 +3,232 @@
 package prc_client
 
 import (
+	"crypto/tls"
+	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 const DEFAULT_RETRY_CONNECTION_DELAY = 5 * time.Second
 
 const DEFAULT_TIMEOUT = 10 * time.Second
 
+const DEFAULT_ENDPOINT_BACKOFF = 30 * time.Second
+
+// Policy to follow when the parallel request controller is unreachable
+type UnavailablePolicy int
+
+const (
+	// Send the messages once connected, waiting up to the timeout (default)
+	UnavailablePolicyWait UnavailablePolicy = iota
+
+	// Fail immediately with ErrUnavailable
+	UnavailablePolicyFailFast
+
+	// Allow every request, without checking the limit
+	UnavailablePolicyFailOpen
+
+	// Enforce the limit locally, dividing it by ExpectedNodeCount
+	UnavailablePolicyLocalFallback
+)
+
+// Strategy to select the connection of the pool to send a message
+// Connections not established are always skipped, unless none of them is established
+type ConnectionSelectionStrategy int
+
+const (
+	// Select the connection with the fewest messages waiting for a response (default)
+	ConnectionSelectionLeastOutstanding ConnectionSelectionStrategy = iota
+
+	// Select the connection with the lowest recent round trip time
+	ConnectionSelectionLowestLatency
+
+	// Select the connections in order
+	ConnectionSelectionRoundRobin
+)
+
 // Configuration of the PRC client
 type ClientConfig struct {
 	// Parallel request controller base URL. Example: ws://example.com:8080
 	Url string
 
+	// List of parallel request controller base URLs, for failover.
+	// If set, Url is ignored
+	Urls []string
+
+	// Shards, each one owned by a different controller.
+	// Every request type is assigned to a shard by consistent hashing on the shard identifiers,
+	// so every client with the same shards agrees on the controller of each type.
+	// If set, Url and Urls are ignored
+	Shards []ShardConfig
+
+	// Strategy to select the endpoint from Urls. By default: EndpointStrategyPrimaryBackup
+	EndpointStrategy EndpointStrategy
+
+	// Time a failed endpoint is skipped when selecting the endpoint to connect to. 30 seconds by default
+	EndpointBackoff time.Duration
+
 	// Number of connections. 1 by default.
 	NumberOfConnections int
 
+	// Strategy to select the connection of the pool to send a message.
+	// By default: ConnectionSelectionLeastOutstanding
+	ConnectionSelection ConnectionSelectionStrategy
+
 	// Authentication token
 	AuthToken string
 
+	// Dialer to open the websocket connections. By default: websocket.DefaultDialer
+	// The fields below override the ones of the dialer if set
+	Dialer *websocket.Dialer
+
+	// TLS configuration, for example to trust a custom root CA
+	TLSClientConfig *tls.Config
+
+	// Extra HTTP headers to send in the websocket handshake
+	Headers http.Header
+
+	// Function to get the HTTP proxy for the connections. Example: http.ProxyFromEnvironment
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Timeout for the websocket handshake. By default, the one of the dialer
+	HandshakeTimeout time.Duration
+
 	// Delay retry the connection. 5 seconds by default
 	RetryConnectionDelay time.Duration
 
 	// Error handler
 	ErrorHandler ErrorHandler
 
+	// Handler for the connection lifecycle events (optional)
+	EventHandler ConnectionEventHandler
+
+	// Handler to collect metrics (optional). See the prc_prometheus and prc_otel packages
+	MetricsHandler MetricsHandler
+
+	// Function to normalize the request types reported to MetricsHandler (optional)
+	MetricsTypeNormalizer MetricsTypeNormalizer
+
 	// Timeout for receiving responses from the server. By default: 10 seconds
 	Timeout time.Duration
+
+	// Policy to follow when the controller is unreachable.
+	// By default: UnavailablePolicyWait
+	// With UnavailablePolicyFailOpen and UnavailablePolicyLocalFallback, the requests started while the controller is unreachable
+	// are sent to the server once connected, so they are counted until they end.
+	// With any policy other than UnavailablePolicyWait, request counts and other queries fail with ErrUnavailable
+	UnavailablePolicy UnavailablePolicy
+
+	// Number of nodes (clients) expected to share the limits. Used by UnavailablePolicyLocalFallback,
+	// which allows limit / ExpectedNodeCount requests per type (at least 1). By default: 1
+	ExpectedNodeCount int
+
+	// Number of permits leased from the server at once, for the request types using prefetching.
+	// The permits are used to start requests without a round trip to the server.
+	// The leased permits count as requests for the limit until returned.
+	// By default: 0 (prefetching disabled)
+	PrefetchPermits uint32
+
+	// Request types using prefetching. By default (empty): every request type
+	PrefetchRequestTypes []string
+
+	// Time without using the leased permits of a type before returning them. By default: 5 seconds
+	PrefetchIdleTimeout time.Duration
+
+	// Registry of the limits of each request type, used by StartRequestByName.
+	// Can be reloaded while the client is running
+	Limits *LimitRegistry
+
+	// Delay the server waits before notifying a change of a watched request type.
+	// Changes happening during the delay are merged into a single update.
+	// By default: 0 (every change is notified)
+	WatchDebounce time.Duration
+}
+
+// Configuration of a shard
+type ShardConfig struct {
+	// Shard identifier. Changing it moves the request types of the shard.
+	// By default: the first URL
+	Id string
+
+	// List of base URLs of the controller owning the shard, for failover
+	Urls []string
+}
+
+// Gets the shard identifier
+func (shardConfig ShardConfig) GetId() string {
+	if shardConfig.Id != "" || len(shardConfig.Urls) == 0 {
+		return shardConfig.Id
+	}
+
+	return shardConfig.Urls[0]
+}
+
+// Gets the shards. A single shard if Shards is not set
+func (config *ClientConfig) GetShards() []ShardConfig {
+	if len(config.Shards) > 0 {
+		return config.Shards
+	}
+
+	return []ShardConfig{
+		{
+			Id:   "",
+			Urls: config.GetEndpoints(),
+		},
+	}
+}
+
+// Gets the dialer to open the websocket connections
+func (config *ClientConfig) GetDialer() *websocket.Dialer {
+	var dialer websocket.Dialer
+
+	if config.Dialer != nil {
+		dialer = *config.Dialer
+	} else {
+		dialer = *websocket.DefaultDialer
+	}
+
+	if config.TLSClientConfig != nil {
+		dialer.TLSClientConfig = config.TLSClientConfig
+	}
+
+	if config.Proxy != nil {
+		dialer.Proxy = config.Proxy
+	}
+
+	if config.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = config.HandshakeTimeout
+	}
+
+	return &dialer
+}
+
+// Gets the list of endpoints (base URLs)
+func (config *ClientConfig) GetEndpoints() []string {
+	if len(config.Urls) > 0 {
+		return config.Urls
+	}
+
+	return []string{config.Url}
 }
 
-// Gets full connection URL (with authentication token)
+// Gets the time a failed endpoint is skipped
+func (config *ClientConfig) GetEndpointBackoff() time.Duration {
+	if config.EndpointBackoff > 0 {
+		return config.EndpointBackoff
+	}
+
+	return DEFAULT_ENDPOINT_BACKOFF
+}
+
+// Gets full connection URL (with authentication token) for the first endpoint
 func (config *ClientConfig) GetFullConnectionUrl() (string, error) {
-	return url.JoinPath(config.Url, "./ws/"+url.PathEscape(config.AuthToken))
+	return config.GetFullEndpointUrl(config.GetEndpoints()[0])
+}
+
+// Gets full connection URL (with authentication token) for an endpoint
+func (config *ClientConfig) GetFullEndpointUrl(endpoint string) (string, error) {
+	return url.JoinPath(endpoint, "./ws/"+url.PathEscape(config.AuthToken))
 }
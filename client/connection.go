@@ -16,6 +16,9 @@ import (
 // Period to send HEARTBEAT messages to the client
 const HEARTBEAT_MSG_PERIOD_SECONDS = 30
 
+// Weight of the last measure when updating the average round trip time
+const ROUND_TRIP_TIME_WEIGHT = 0.2
+
 // Pending request
 type PendingRequest struct {
 	// Request type
@@ -23,6 +26,27 @@ type PendingRequest struct {
 
 	// Parallel request limit
 	limit uint32
+
+	// Number of slots taken by the request
+	weight uint32
+
+	// True if the request was already started locally (while the server was unreachable),
+	// so the server must count it regardless of the limit
+	force bool
+
+	// True if the server started the request
+	started bool
+
+	// Channel closed when the server releases the slot without the request being ended
+	lost chan struct{}
+}
+
+// Marks a pending request as lost, since the server released the slot
+func (req *PendingRequest) markLost() {
+	if req.started {
+		req.started = false
+		close(req.lost)
+	}
 }
 
 // Connection to a PRC server
@@ -36,32 +60,76 @@ type Connection struct {
 	// Mutex for the struct
 	mu *sync.Mutex
 
+	// Shard of the connection
+	shard *Shard
+
+	// Index of the connection in the pool of the shard
+	index int
+
 	// True if the client is connected
 	connected bool
 
+	// True if the connection was established at least once since Connect was called
+	hasConnected bool
+
 	// Socket
 	socket *websocket.Conn
 
+	// Endpoint (base URL) of the socket
+	endpoint string
+
 	// Wait group to prevent multiple connections
 	closeWaitGroup *sync.WaitGroup
 
 	// Pending request to send on connection
 	pendingRequests map[uint64]*PendingRequest
 
-	// Pending request counts
-	pendingRequestCounts map[string]int
+	// Watched request types, subscribed again on connection
+	watchedRequestTypes map[string]bool
+
+	// Request types and prefixes frozen by the client, resumed on connection
+	freezes map[FreezeTarget]bool
+
+	// ID of the freezes made by the connection, so the server keeps them while reconnecting
+	freezeId string
+
+	// Pending queries to send on connection
+	pendingQueries map[uint64]*simple_rpc_message.RPCMessage
+
+	// Map (Request ID) -> Time the START-REQUEST message was sent, for the requests waiting for the ACK
+	awaitingAck map[uint64]time.Time
+
+	// Map (Query ID) -> Time the query was sent, for the queries waiting for the reply
+	awaitingReply map[uint64]time.Time
+
+	// Average round trip time
+	roundTripTime time.Duration
+
+	// Number of times the connection was lost. Tells if a reply was received before the current socket was established
+	epoch uint64
 }
 
 func NewConnection(cli *Client, config *ClientConfig) *Connection {
 	return &Connection{
-		cli:                  cli,
-		config:               config,
-		mu:                   &sync.Mutex{},
-		connected:            false,
-		socket:               nil,
-		closeWaitGroup:       nil,
-		pendingRequests:      make(map[uint64]*PendingRequest),
-		pendingRequestCounts: make(map[string]int),
+		cli:                 cli,
+		config:              config,
+		mu:                  &sync.Mutex{},
+		shard:               nil,
+		index:               0,
+		connected:           false,
+		hasConnected:        false,
+		socket:              nil,
+		endpoint:            "",
+		closeWaitGroup:      nil,
+		pendingRequests:     make(map[uint64]*PendingRequest),
+		watchedRequestTypes: make(map[string]bool),
+		freezes:             make(map[FreezeTarget]bool),
+		freezeId:            makeFreezeId(),
+		pendingQueries:      make(map[uint64]*simple_rpc_message.RPCMessage),
+		awaitingAck:         make(map[uint64]time.Time),
+		awaitingReply:       make(map[uint64]time.Time),
+		roundTripTime:       0,
+		epoch:               0,
 	}
 }
 
@@ -70,10 +138,12 @@ func (conn *Connection) Connect() {
 	conn.mu.Lock()
 
 	if conn.connected {
+		conn.mu.Unlock()
 		return
 	}
 
 	conn.connected = true
+	conn.hasConnected = false
 
 	conn.mu.Unlock()
 
@@ -86,7 +156,24 @@ func (conn *Connection) Close() {
 
 	// Clear
 
+	for _, req := range conn.pendingRequests {
+		req.markLost()
+	}
+
 	conn.pendingRequests = make(map[uint64]*PendingRequest)
+	conn.awaitingAck = make(map[uint64]time.Time)
+
+	// Release the freezes, so they are not kept by the server, nor made again on connection
+
+	for target := range conn.freezes {
+		if conn.socket != nil {
+			msg := makeFreezeMessage("UNFREEZE", target, conn.freezeId)
+
+			conn.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+		}
+	}
+
+	conn.freezes = make(map[FreezeTarget]bool)
 
 	conn.mu.Unlock()
 
@@ -119,6 +206,22 @@ func (conn *Connection) closeInternal() *sync.WaitGroup {
 	return conn.closeWaitGroup
 }
 
+// Checks if the connection is established, so messages can be sent
+func (conn *Connection) IsConnected() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.socket != nil
+}
+
+// Gets the epoch of the connection, increased every time the connection is lost
+func (conn *Connection) Epoch() uint64 {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	return conn.epoch
+}
+
 // Checks if the client is closed
 func (conn *Connection) IsClosed() bool {
 	conn.mu.Lock()
@@ -142,44 +245,92 @@ func (conn *Connection) afterClose() {
 }
 
 // Call when connected
-// Returns false if the connection must be closed
-func (conn *Connection) onConnected(socket *websocket.Conn) bool {
+// Returns:
+// - ok - False if the connection must be closed
+// - reconnected - True if the connection was established before
+func (conn *Connection) onConnected(socket *websocket.Conn, endpoint string) (ok bool, reconnected bool) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
+	if !conn.connected {
+		return false, false
+	}
+
 	conn.socket = socket
+	conn.endpoint = endpoint
+
+	reconnected = conn.hasConnected
+	conn.hasConnected = true
+
+	// The round trip time is measured from now for the messages sent again
+
+	now := time.Now()
+
+	for id := range conn.awaitingAck {
+		conn.awaitingAck[id] = now
+	}
+
+	for id := range conn.awaitingReply {
+		conn.awaitingReply[id] = now
+	}
+
+	// Resume the freezes, since the server removes them if the client does not come back
+	// The server does not resume the freezes removed in the meantime
+
+	for target := range conn.freezes {
+		msg := makeFreezeMessage("FREEZE", target, conn.freezeId)
+		msg.Params["Freeze-Resume"] = "TRUE"
+
+		conn.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+	}
 
 	// Send pending requests
 
 	for id, req := range conn.pendingRequests {
-		msg := simple_rpc_message.RPCMessage{
-			Method: "START-REQUEST",
-			Params: map[string]string{
-				"Request-ID":    fmt.Sprint(id),
-				"Request-Type":  req.requestType,
-				"Request-Limit": fmt.Sprint(req.limit),
-			},
-			Body: "",
-		}
+		msg := makeStartRequestMessage(id, req)
 
 		conn.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
 	}
 
-	// Send pending request counts
+	// Subscribe to watched request types
 
-	for rType := range conn.pendingRequestCounts {
-		msg := simple_rpc_message.RPCMessage{
-			Method: "GET-REQUEST-COUNT",
-			Params: map[string]string{
-				"Request-Type": rType,
-			},
-			Body: "",
-		}
+	for rType := range conn.watchedRequestTypes {
+		msg := conn.makeWatchRequestTypeMessage(rType)
 
 		conn.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
 	}
 
-	return conn.connected
+	// Send pending queries
+
+	for _, msg := range conn.pendingQueries {
+		conn.socket.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+	}
+
+	return true, reconnected
+}
+
+// Call when the connection is lost
+// The server releases the slots of the requests, so they are marked as lost
+// The requests started locally are kept, in order to send them again on connection
+func (conn *Connection) onDisconnected() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.socket = nil
+	conn.endpoint = ""
+	conn.epoch++
+
+	for id, req := range conn.pendingRequests {
+		if req.force {
+			req.started = false
+			continue
+		}
+
+		if req.started {
+			req.markLost()
+			delete(conn.pendingRequests, id)
+		}
+	}
 }
 
 // Runs connection loop
@@ -193,19 +344,29 @@ func (conn *Connection) runConnectionLoop() {
 			return
 		}
 
-		url, err := conn.config.GetFullConnectionUrl()
+		endpoint := conn.shard.endpointSelector.Next()
+
+		url, err := conn.config.GetFullEndpointUrl(endpoint)
 
 		if err != nil {
 			return
 		}
 
-		socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+		socket, _, err := conn.config.GetDialer().Dial(url, conn.config.Headers)
 
 		if err != nil {
+			conn.shard.endpointSelector.MarkDown(endpoint)
+
 			if conn.config.ErrorHandler != nil {
 				conn.config.ErrorHandler.OnConnectionError(err)
 			}
 
+			// Try the next endpoint right away, unless all of them failed
+
+			if conn.shard.endpointSelector.HasAvailable() {
+				continue
+			}
+
 			if conn.config.RetryConnectionDelay == 0 {
 				time.Sleep(DEFAULT_RETRY_CONNECTION_DELAY)
 			} else if conn.config.RetryConnectionDelay > 0 {
@@ -215,25 +376,59 @@ func (conn *Connection) runConnectionLoop() {
 			continue
 		}
 
+		conn.shard.endpointSelector.MarkUp(endpoint)
+
 		// Set connection
 
-		isConnected := conn.onConnected(socket)
+		isConnected, reconnected := conn.onConnected(socket, endpoint)
 
 		if !isConnected {
 			socket.Close()
 			return
 		}
 
+		conn.cli.onConnectionStateChanged(1)
+
+		if reconnected && conn.config.MetricsHandler != nil {
+			conn.config.MetricsHandler.OnReconnected(conn.shard.id)
+		}
+
+		if conn.config.EventHandler != nil {
+			if reconnected {
+				conn.config.EventHandler.OnReconnected(ConnectionEvent{ShardId: conn.shard.id, ConnectionIndex: conn.index, Url: endpoint})
+			} else {
+				conn.config.EventHandler.OnConnected(ConnectionEvent{ShardId: conn.shard.id, ConnectionIndex: conn.index, Url: endpoint})
+			}
+		}
+
 		go conn.sendHeartbeatMessages(socket)
 
 		// Read messages and close
 
-		conn.readIncomingMessages(socket)
+		err = conn.readIncomingMessages(socket)
+
+		conn.onDisconnected()
+
+		conn.cli.onPermitsLost(conn)
+
+		conn.cli.onConnectionStateChanged(-1)
+
+		if conn.IsClosed() {
+			err = nil
+		} else {
+			// Prefer other endpoints when reconnecting
+			conn.shard.endpointSelector.MarkDown(endpoint)
+		}
+
+		if conn.config.EventHandler != nil {
+			conn.config.EventHandler.OnDisconnected(ConnectionEvent{ShardId: conn.shard.id, ConnectionIndex: conn.index, Url: endpoint, Err: err})
+		}
 	}
 }
 
 // Reads incoming messages
-func (conn *Connection) readIncomingMessages(socket *websocket.Conn) {
+// Returns the error that caused the connection to be lost
+func (conn *Connection) readIncomingMessages(socket *websocket.Conn) error {
 	defer socket.Close()
 
 	for {
@@ -243,7 +438,7 @@ func (conn *Connection) readIncomingMessages(socket *websocket.Conn) {
 			if !conn.IsClosed() && conn.config.ErrorHandler != nil {
 				conn.config.ErrorHandler.OnConnectionError(err)
 			}
-			return
+			return err
 		}
 
 		mt, message, err := socket.ReadMessage()
@@ -252,7 +447,7 @@ func (conn *Connection) readIncomingMessages(socket *websocket.Conn) {
 			if !conn.IsClosed() && conn.config.ErrorHandler != nil {
 				conn.config.ErrorHandler.OnConnectionError(err)
 			}
-			return
+			return err
 		}
 
 		if mt != websocket.TextMessage {
@@ -263,13 +458,25 @@ func (conn *Connection) readIncomingMessages(socket *websocket.Conn) {
 
 		switch strings.ToUpper(parsedMessage.Method) {
 		case "ERROR":
-			if conn.config.ErrorHandler != nil {
-				conn.config.ErrorHandler.OnServerError(parsedMessage.GetParam("Error-Code"), parsedMessage.GetParam("Error-Message"))
-			}
+			conn.ReceiveError(&parsedMessage)
 		case "START-REQUEST-ACK":
 			conn.ReceiveStartRequestAck(&parsedMessage)
 		case "REQUEST-COUNT":
-			conn.ReceiveRequestCount(&parsedMessage)
+			if parsedMessage.GetParam("Query-ID") != "" {
+				conn.ReceiveQueryReply(&parsedMessage)
+			} else {
+				conn.ReceiveRequestCount(&parsedMessage)
+			}
+		case "FREEZE-ACK":
+			if parsedMessage.GetParam("Query-ID") != "" {
+				conn.ReceiveQueryReply(&parsedMessage)
+			} else {
+				conn.ReceiveFreezeResumed(&parsedMessage)
+			}
+		case "REQUEST-COUNTS", "UNFREEZE-ACK", "DRAINED", "PERMITS-LEASED":
+			conn.ReceiveQueryReply(&parsedMessage)
+		case "PERMITS-REVOKED":
+			conn.cli.onPermitsRevoked(conn, parsedMessage.GetParam("Request-Type"))
 		}
 	}
 }
@@ -304,38 +511,77 @@ func (conn *Connection) Send(msg *simple_rpc_message.RPCMessage) {
 	}
 }
 
-// Sends START-REQUEST message
-func (conn *Connection) sendStartRequest(id uint64, rType string, limit uint32) {
-	msg := simple_rpc_message.RPCMessage{
-		Method: "START-REQUEST",
-		Params: map[string]string{
-			"Request-ID":    fmt.Sprint(id),
-			"Request-Type":  rType,
-			"Request-Limit": fmt.Sprint(limit),
-		},
-		Body: "",
+// Makes START-REQUEST message
+func makeStartRequestMessage(id uint64, req *PendingRequest) *simple_rpc_message.RPCMessage {
+	params := map[string]string{
+		"Request-ID":    fmt.Sprint(id),
+		"Request-Type":  req.requestType,
+		"Request-Limit": fmt.Sprint(req.limit),
 	}
 
-	conn.Send(&msg)
+	if req.force {
+		params["Request-Force"] = "TRUE"
+	}
+
+	if req.weight > 1 {
+		params["Request-Weight"] = fmt.Sprint(req.weight)
+	}
+
+	return &simple_rpc_message.RPCMessage{
+		Method: "START-REQUEST",
+		Params: params,
+		Body:   "",
+	}
 }
 
 // Sends END-REQUEST message
-func (conn *Connection) sendEndRequest(id uint64) {
+// Parameters:
+// - id - Request ID
+// - success - Value of the Request-Success parameter. Empty to not report the outcome
+// - weight - Number of slots to release. 0 to release all of them
+func (conn *Connection) sendEndRequest(id uint64, success string, weight uint32) {
+	params := map[string]string{
+		"Request-ID": fmt.Sprint(id),
+	}
+
+	if success != "" {
+		params["Request-Success"] = success
+	}
+
+	if weight > 0 {
+		params["Request-Weight"] = fmt.Sprint(weight)
+	}
+
 	msg := simple_rpc_message.RPCMessage{
 		Method: "END-REQUEST",
-		Params: map[string]string{
-			"Request-ID": fmt.Sprint(id),
-		},
-		Body: "",
+		Params: params,
+		Body:   "",
 	}
 
 	conn.Send(&msg)
 }
 
-// Sends GET-REQUEST-COUNT message
-func (conn *Connection) sendGetRequestCount(rType string) {
+// Makes WATCH-REQUEST-TYPE message
+func (conn *Connection) makeWatchRequestTypeMessage(rType string) *simple_rpc_message.RPCMessage {
+	params := map[string]string{
+		"Request-Type": rType,
+	}
+
+	if conn.config.WatchDebounce > 0 {
+		params["Debounce"] = fmt.Sprint(conn.config.WatchDebounce.Milliseconds())
+	}
+
+	return &simple_rpc_message.RPCMessage{
+		Method: "WATCH-REQUEST-TYPE",
+		Params: params,
+		Body:   "",
+	}
+}
+
+// Sends UNWATCH-REQUEST-TYPE message
+func (conn *Connection) sendUnwatchRequestType(rType string) {
 	msg := simple_rpc_message.RPCMessage{
-		Method: "GET-REQUEST-COUNT",
+		Method: "UNWATCH-REQUEST-TYPE",
 		Params: map[string]string{
 			"Request-Type": rType,
 		},
@@ -346,28 +592,129 @@ func (conn *Connection) sendGetRequestCount(rType string) {
 }
 
 // Starts request, either by sending a START-REQUEST message or waiting for connection
-func (conn *Connection) StartRequest(id uint64, rType string, limit uint32) {
+// Returns a channel closed if the server releases the slot without the request being ended
+func (conn *Connection) StartRequest(id uint64, rType string, limit uint32, weight uint32) <-chan struct{} {
+	req := &PendingRequest{
+		requestType: rType,
+		limit:       limit,
+		weight:      weight,
+		force:       false,
+		started:     false,
+		lost:        make(chan struct{}),
+	}
+
 	conn.mu.Lock()
 
-	conn.pendingRequests[id] = &PendingRequest{
+	conn.pendingRequests[id] = req
+	conn.awaitingAck[id] = time.Now()
+
+	conn.mu.Unlock()
+
+	conn.Send(makeStartRequestMessage(id, req))
+
+	return req.lost
+}
+
+// Registers a request started locally while the server was unreachable
+// The request is sent on connection, so the server counts it regardless of the limit
+// Returns a channel closed if the server releases the slot without the request being ended
+func (conn *Connection) StartLocalRequest(id uint64, rType string, limit uint32, weight uint32) <-chan struct{} {
+	req := &PendingRequest{
 		requestType: rType,
 		limit:       limit,
+		weight:      weight,
+		force:       true,
+		started:     false,
+		lost:        make(chan struct{}),
 	}
 
+	conn.mu.Lock()
+
+	conn.pendingRequests[id] = req
+	conn.awaitingAck[id] = time.Now()
+
 	conn.mu.Unlock()
 
-	conn.sendStartRequest(id, rType, limit)
+	conn.Send(makeStartRequestMessage(id, req))
+
+	return req.lost
 }
 
 // Ends a request, by sending the END-REQUEST message
 func (conn *Connection) EndRequest(id uint64) {
+	conn.EndRequestWithOutcome(id, "")
+}
+
+// Ends a request, by sending the END-REQUEST message
+// Parameters:
+// - id - Request ID
+// - success - Value of the Request-Success parameter (TRUE or FALSE). Empty to not report the outcome
+func (conn *Connection) EndRequestWithOutcome(id uint64, success string) {
 	conn.mu.Lock()
 
 	delete(conn.pendingRequests, id)
+	delete(conn.awaitingAck, id)
+
+	conn.mu.Unlock()
+
+	conn.sendEndRequest(id, success, 0)
+}
+
+// Releases some slots of a request, by sending the END-REQUEST message with the number of slots
+// The request keeps the rest of its slots, also if it is sent again on connection
+// Parameters:
+// - id - Request ID
+// - weight - Number of slots to release. Must be less than the slots held by the request
+func (conn *Connection) ReleaseRequestSlots(id uint64, weight uint32) {
+	conn.mu.Lock()
+
+	if req := conn.pendingRequests[id]; req != nil && weight < req.weight {
+		req.weight -= weight
+	}
 
 	conn.mu.Unlock()
 
-	conn.sendEndRequest(id)
+	conn.sendEndRequest(id, "", weight)
+}
+
+// Forgets a request that was not started (limited), so it is not sent again on connection
+func (conn *Connection) ForgetRequest(id uint64) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	delete(conn.pendingRequests, id)
+	delete(conn.awaitingAck, id)
+}
+
+// Receives message: ERROR
+// If the error is related to a call waiting for a response, the call returns the error
+// Otherwise, the error is sent to the error handler
+func (conn *Connection) ReceiveError(msg *simple_rpc_message.RPCMessage) {
+	serverError := &ServerError{
+		Code:    msg.GetParam("Error-Code"),
+		Message: msg.GetParam("Error-Message"),
+	}
+
+	if requestId, err := strconv.ParseUint(msg.GetParam("Request-ID"), 10, 64); err == nil {
+		conn.onAckReceived(requestId, false)
+
+		if conn.cli.receiveRequestAck(requestId, &RequestStartAck{err: serverError}) {
+			return
+		}
+	}
+
+	if queryId, err := strconv.ParseUint(msg.GetParam("Query-ID"), 10, 64); err == nil {
+		conn.onReplyReceived(queryId)
+		conn.QueryDone(queryId)
+
+		if conn.cli.receiveQueryReply(queryId, &QueryReply{message: msg, epoch: conn.Epoch()}) {
+			return
+		}
+	}
+
+	if conn.config.ErrorHandler != nil {
+		conn.config.ErrorHandler.OnServerError(serverError.Code, serverError.Message)
+	}
 }
 
 // Receives message: START-REQUEST-ACK
@@ -385,59 +732,222 @@ func (conn *Connection) ReceiveStartRequestAck(msg *simple_rpc_message.RPCMessag
 
 	limitedStr := strings.ToUpper(msg.GetParam("Request-Limit-Reached"))
 
-	limited := limitedStr == "TRUE"
+	ack := &RequestStartAck{
+		limited: limitedStr == "TRUE",
+		frozen:  strings.ToUpper(msg.GetParam("Request-Type-Frozen")) == "TRUE",
+	}
+
+	// Details (optional)
 
-	conn.cli.receiveRequestAck(id, limited)
+	if count, err := strconv.ParseUint(msg.GetParam("Request-Count"), 10, 32); err == nil {
+		ack.count = uint32(count)
+	}
+
+	if limit, err := strconv.ParseUint(msg.GetParam("Request-Limit"), 10, 32); err == nil {
+		ack.limit = uint32(limit)
+	}
+
+	if retryAfter, err := strconv.ParseUint(msg.GetParam("Retry-After"), 10, 32); err == nil {
+		ack.retryAfter = time.Duration(retryAfter) * time.Millisecond
+	}
+
+	conn.onAckReceived(id, !ack.limited)
+
+	if ack.limited {
+		conn.onRequestLimited(id)
+	}
+
+	conn.cli.receiveRequestAck(id, ack)
 }
 
-// Sends GET-REQUEST-COUNT message to get the request count for a specific type
-func (conn *Connection) GetRequestCount(rType string) {
-	conn.mu.Lock()
+// Receives REQUEST-COUNT message, sent to notify a change of a watched request type
+func (conn *Connection) ReceiveRequestCount(msg *simple_rpc_message.RPCMessage) {
+	reqType := msg.GetParam("Request-Type")
+	reqCountStr := msg.GetParam("Request-Count")
 
-	c := conn.pendingRequestCounts[rType]
+	reqCount, err := strconv.ParseUint(reqCountStr, 10, 32)
 
-	if c == 0 {
-		conn.pendingRequestCounts[rType] = 1
-	} else {
-		conn.pendingRequestCounts[rType] = c + 1
+	if err != nil {
+		if conn.config.ErrorHandler != nil {
+			conn.config.ErrorHandler.OnServerError("PROTOCOL_ERROR", "Server send an invalid Request-Count parameter for message REQUEST-COUNT")
+		}
+		return
 	}
 
+	conn.cli.receiveRequestCount(reqType, uint32(reqCount))
+}
+
+// Subscribes to the changes of a request type. The subscription is renewed on every connection
+func (conn *Connection) WatchRequestType(rType string) {
+	conn.mu.Lock()
+
+	conn.watchedRequestTypes[rType] = true
+
 	conn.mu.Unlock()
 
-	conn.sendGetRequestCount(rType)
+	conn.Send(conn.makeWatchRequestTypeMessage(rType))
 }
 
-// Call after a request count is done, either by receiving the response or due to timeout
-func (conn *Connection) RequestCountDone(rType string) {
+// Removes the subscription to the changes of a request type
+func (conn *Connection) UnwatchRequestType(rType string) {
 	conn.mu.Lock()
 
-	c := conn.pendingRequestCounts[rType]
+	delete(conn.watchedRequestTypes, rType)
 
-	if c > 0 {
-		if c == 1 {
-			delete(conn.pendingRequestCounts, rType)
-		} else {
-			conn.pendingRequestCounts[rType] = c - 1
-		}
+	conn.mu.Unlock()
+
+	conn.sendUnwatchRequestType(rType)
+}
+
+// Registers a freeze sent by the client, in order to send it again on connection
+func (conn *Connection) AddFreeze(target FreezeTarget) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.freezes[target] = true
+}
+
+// Removes a freeze, so it is no longer sent on connection
+func (conn *Connection) RemoveFreeze(target FreezeTarget) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	delete(conn.freezes, target)
+}
+
+// Receives the reply to a freeze resumed on connection
+// If the freeze was removed while the client was disconnected, it is no longer resumed
+func (conn *Connection) ReceiveFreezeResumed(msg *simple_rpc_message.RPCMessage) {
+	if strings.ToUpper(msg.GetParam("Frozen")) != "FALSE" {
+		return
+	}
 
+	if rType := msg.GetParam("Request-Type"); rType != "" {
+		conn.RemoveFreeze(FreezeTarget{param: "Request-Type", target: rType})
+	} else if prefix := msg.GetParam("Request-Type-Prefix"); prefix != "" {
+		conn.RemoveFreeze(FreezeTarget{param: "Request-Type-Prefix", target: prefix})
 	}
+}
+
+// Sends a query message, sending it again on connection until QueryDone is called
+func (conn *Connection) SendQuery(id uint64, msg *simple_rpc_message.RPCMessage) {
+	conn.mu.Lock()
+
+	conn.pendingQueries[id] = msg
+	conn.awaitingReply[id] = time.Now()
 
 	conn.mu.Unlock()
+
+	conn.Send(msg)
 }
 
-// Receives REQUEST-COUNT message
-func (conn *Connection) ReceiveRequestCount(msg *simple_rpc_message.RPCMessage) {
-	reqType := msg.GetParam("Request-Type")
-	reqCountStr := msg.GetParam("Request-Count")
+// Call after a query is done, either by receiving the reply or due to timeout
+func (conn *Connection) QueryDone(id uint64) {
+	conn.mu.Lock()
 
-	reqCount, err := strconv.ParseUint(reqCountStr, 10, 32)
+	delete(conn.pendingQueries, id)
+	delete(conn.awaitingReply, id)
+
+	conn.mu.Unlock()
+}
+
+// Records the round trip time of a message, given the time it was sent
+// Call with the mutex locked
+func (conn *Connection) recordRoundTripTime(sentTime time.Time) {
+	rtt := time.Since(sentTime)
+
+	if conn.roundTripTime == 0 {
+		conn.roundTripTime = rtt
+	} else {
+		conn.roundTripTime = time.Duration(ROUND_TRIP_TIME_WEIGHT*float64(rtt) + (1-ROUND_TRIP_TIME_WEIGHT)*float64(conn.roundTripTime))
+	}
+}
+
+// Call when the server responds to a START-REQUEST message
+// Parameters:
+// - id - Request ID
+// - started - True if the server started the request
+func (conn *Connection) onAckReceived(id uint64, started bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if sentTime, ok := conn.awaitingAck[id]; ok {
+		conn.recordRoundTripTime(sentTime)
+		delete(conn.awaitingAck, id)
+	}
+
+	if req := conn.pendingRequests[id]; req != nil && started {
+		req.started = true
+	}
+}
+
+// Call when the server limits a request
+// A request started locally is sent with Request-Force, but servers not accepting forced requests limit it.
+// The server does not count it, so it is marked as lost and not sent again.
+func (conn *Connection) onRequestLimited(id uint64) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if req := conn.pendingRequests[id]; req != nil && req.force {
+		close(req.lost)
+		delete(conn.pendingRequests, id)
+	}
+}
+
+// Call when the server responds to a query
+func (conn *Connection) onReplyReceived(id uint64) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if sentTime, ok := conn.awaitingReply[id]; ok {
+		conn.recordRoundTripTime(sentTime)
+	}
+}
+
+// Receives a query reply message
+func (conn *Connection) ReceiveQueryReply(msg *simple_rpc_message.RPCMessage) {
+	idStr := msg.GetParam("Query-ID")
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
 
 	if err != nil {
 		if conn.config.ErrorHandler != nil {
-			conn.config.ErrorHandler.OnServerError("PROTOCOL_ERROR", "Server send an invalid Request-Count parameter for message REQUEST-COUNT")
+			conn.config.ErrorHandler.OnServerError("PROTOCOL_ERROR", "Server send an invalid Query-ID parameter for message "+msg.Method)
 		}
 		return
 	}
 
-	conn.cli.receiveRequestCount(reqType, uint32(reqCount))
+	conn.onReplyReceived(id)
+	conn.QueryDone(id)
+
+	if !conn.cli.receiveQueryReply(id, &QueryReply{message: msg, epoch: conn.Epoch()}) {
+		// Nobody is waiting for the reply
+		conn.returnLeasedPermits(msg)
+	}
+}
+
+// Returns the permits leased by a reply nobody is waiting for
+// Does nothing if the message is not a PERMITS-LEASED reply
+func (conn *Connection) returnLeasedPermits(msg *simple_rpc_message.RPCMessage) {
+	if msg.Method != "PERMITS-LEASED" {
+		return
+	}
+
+	if permits, err := strconv.ParseUint(msg.GetParam("Permits"), 10, 32); err == nil && permits > 0 {
+		conn.sendReturnPermits(msg.GetParam("Request-Type"), uint32(permits))
+	}
+}
+
+// Sends RETURN-PERMITS message
+func (conn *Connection) sendReturnPermits(rType string, permits uint32) {
+	msg := simple_rpc_message.RPCMessage{
+		Method: "RETURN-PERMITS",
+		Params: map[string]string{
+			"Request-Type": rType,
+			"Permits":      fmt.Sprint(permits),
+		},
+		Body: "",
+	}
+
+	conn.Send(&msg)
 }
@@ -0,0 +1,71 @@
+// Connection statistics
+
+package prc_client
+
+import "time"
+
+// Statistics of a connection
+type ConnectionStats struct {
+	// Identifier of the shard of the connection
+	ShardId string
+
+	// Index of the connection in the pool of the shard
+	ConnectionIndex int
+
+	// Endpoint (base URL) of the connection. Empty if not connected
+	Url string
+
+	// True if the connection is established
+	Connected bool
+
+	// Number of requests started and not yet ended
+	ActiveRequests int
+
+	// Number of START-REQUEST messages waiting for the ACK
+	OutstandingAcks int
+
+	// Number of queries waiting for the reply
+	OutstandingQueries int
+
+	// Average round trip time of the recent messages. 0 if not measured yet
+	RoundTripTime time.Duration
+}
+
+// Gets the number of messages waiting for a response
+func (stats *ConnectionStats) Outstanding() int {
+	return stats.OutstandingAcks + stats.OutstandingQueries
+}
+
+// Gets the statistics of the connection
+func (conn *Connection) GetStats() ConnectionStats {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	shardId := ""
+
+	if conn.shard != nil {
+		shardId = conn.shard.id
+	}
+
+	return ConnectionStats{
+		ShardId:            shardId,
+		ConnectionIndex:    conn.index,
+		Url:                conn.endpoint,
+		Connected:          conn.socket != nil,
+		ActiveRequests:     len(conn.pendingRequests),
+		OutstandingAcks:    len(conn.awaitingAck),
+		OutstandingQueries: len(conn.awaitingReply),
+		RoundTripTime:      conn.roundTripTime,
+	}
+}
+
+// Gets the statistics of every connection of the client
+func (cli *Client) ConnectionStats() []ConnectionStats {
+	stats := make([]ConnectionStats, len(cli.connections))
+
+	for i, conn := range cli.connections {
+		stats[i] = conn.GetStats()
+	}
+
+	return stats
+}
@@ -0,0 +1,197 @@
+// Multiple request counts
+
+package prc_client
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+// Parses the body of a REQUEST-COUNTS message
+// Each line contains a request type and its count, separated by a colon
+func parseRequestCounts(body string, counts map[string]uint32) error {
+	for _, line := range strings.Split(body, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		colonIndex := strings.LastIndex(line, ":")
+
+		if colonIndex < 0 {
+			return ErrInvalidResponse
+		}
+
+		count, err := strconv.ParseUint(strings.TrimSpace(line[colonIndex+1:]), 10, 32)
+
+		if err != nil {
+			return ErrInvalidResponse
+		}
+
+		counts[strings.TrimSpace(line[:colonIndex])] = uint32(count)
+	}
+
+	return nil
+}
+
+// Sends a GET-REQUEST-COUNTS message and waits for the reply
+func (cli *Client) sendGetRequestCounts(ctx context.Context, conn *Connection, msg *simple_rpc_message.RPCMessage) (*simple_rpc_message.RPCMessage, error) {
+	timeoutCtx, cancel := cli.withTimeout(ctx)
+	defer cancel()
+
+	reply, err := cli.sendQuery(timeoutCtx, conn, msg)
+
+	if err != nil {
+		return nil, queryError(ctx, conn, err)
+	}
+
+	return reply, nil
+}
+
+// Gets the current number of parallel requests of multiple types
+// The counts are read by the server at the same time
+// Parameters:
+// - requestTypes - List of request types
+// Returns:
+// - counts - Map (request type) -> (current number of parallel requests)
+// - err - An error that prevented the request counts from completing
+func (cli *Client) GetRequestCounts(requestTypes ...string) (counts map[string]uint32, err error) {
+	return cli.GetRequestCountsContext(context.Background(), requestTypes...)
+}
+
+// Gets the current number of parallel requests of multiple types, waiting for the server response until the context finishes
+// Parameters:
+// - ctx - Context to cancel the wait. The configured timeout also applies
+// - requestTypes - List of request types
+// Returns:
+// - counts - Map (request type) -> (current number of parallel requests)
+// - err - An error that prevented the request counts from completing. The context error if it finished
+func (cli *Client) GetRequestCountsContext(ctx context.Context, requestTypes ...string) (counts map[string]uint32, err error) {
+	for _, requestType := range requestTypes {
+		if requestType == "" || strings.Contains(requestType, "\n") {
+			return nil, ErrInvalidRequestType
+		}
+	}
+
+	counts = make(map[string]uint32)
+
+	if len(requestTypes) == 0 {
+		return counts, nil
+	}
+
+	// Group the types by shard
+
+	typesByShard := make(map[*Shard][]string)
+
+	for _, requestType := range requestTypes {
+		shard := cli.getShard(requestType)
+		typesByShard[shard] = append(typesByShard[shard], requestType)
+	}
+
+	for _, shard := range cli.shards {
+		shardTypes := typesByShard[shard]
+
+		if len(shardTypes) == 0 {
+			continue
+		}
+
+		conn, _ := cli.getAvailableConnectionFromPool(shard)
+
+		msg := &simple_rpc_message.RPCMessage{
+			Method: "GET-REQUEST-COUNTS",
+			Params: map[string]string{},
+			Body:   strings.Join(shardTypes, "\n"),
+		}
+
+		reply, err := cli.sendGetRequestCounts(ctx, conn, msg)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = parseRequestCounts(reply.Body, counts)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+// Lists the current number of parallel requests of every type starting with a prefix
+// Only the types with requests being handled are listed
+// Large results are fetched in multiple pages, each page being read by the server at a different time
+// Parameters:
+// - prefix - Request type prefix. Empty to list every type
+// Returns:
+// - counts - Map (request type) -> (current number of parallel requests)
+// - err - An error that prevented the listing from completing
+func (cli *Client) ListRequestCounts(prefix string) (counts map[string]uint32, err error) {
+	return cli.ListRequestCountsContext(context.Background(), prefix)
+}
+
+// Lists the current number of parallel requests of every type starting with a prefix, waiting for the server responses until the context finishes
+// Parameters:
+// - ctx - Context to cancel the wait. The configured timeout applies to each page
+// - prefix - Request type prefix. Empty to list every type
+// Returns:
+// - counts - Map (request type) -> (current number of parallel requests)
+// - err - An error that prevented the listing from completing. The context error if it finished
+func (cli *Client) ListRequestCountsContext(ctx context.Context, prefix string) (counts map[string]uint32, err error) {
+	counts = make(map[string]uint32)
+
+	// The types with the prefix can be in any shard
+
+	for _, shard := range cli.shards {
+		err = cli.listShardRequestCounts(ctx, shard, prefix, counts)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+// Lists the current number of parallel requests of every type starting with a prefix, in a single shard
+func (cli *Client) listShardRequestCounts(ctx context.Context, shard *Shard, prefix string, counts map[string]uint32) error {
+	conn, _ := cli.getAvailableConnectionFromPool(shard)
+	cursor := ""
+
+	for {
+		params := map[string]string{
+			"Request-Type-Prefix": prefix,
+		}
+
+		if cursor != "" {
+			params["Cursor"] = cursor
+		}
+
+		msg := &simple_rpc_message.RPCMessage{
+			Method: "GET-REQUEST-COUNTS",
+			Params: params,
+			Body:   "",
+		}
+
+		reply, err := cli.sendGetRequestCounts(ctx, conn, msg)
+
+		if err != nil {
+			return err
+		}
+
+		err = parseRequestCounts(reply.Body, counts)
+
+		if err != nil {
+			return err
+		}
+
+		cursor = reply.GetParam("Next-Cursor")
+
+		if cursor == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Dialer configuration test
+
+package prc_client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConnectionErrorHandler struct {
+	errors chan error
+}
+
+func (th *testConnectionErrorHandler) OnConnectionError(err error) {
+	select {
+	case th.errors <- err:
+	default:
+	}
+}
+
+func (th *testConnectionErrorHandler) OnServerError(code string, message string) {
+}
+
+// Creates a TLS websocket server accepting connections with the X-Test header
+func createTestTLSServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test") != "test-value" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		socket, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		defer socket.Close()
+
+		for {
+			_, _, err := socket.ReadMessage()
+
+			if err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestClientDialer(t *testing.T) {
+	server := createTestTLSServer(t)
+	defer server.Close()
+
+	serverUrl := "wss://" + strings.TrimPrefix(server.URL, "https://")
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	// The server certificate is not trusted by default
+
+	th := &testConnectionErrorHandler{
+		errors: make(chan error, 1),
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  serverUrl,
+		AuthToken:            "test",
+		ErrorHandler:         th,
+		RetryConnectionDelay: 50 * time.Millisecond,
+		Headers: http.Header{
+			"X-Test": []string{"test-value"},
+		},
+	})
+
+	cli.Connect()
+
+	select {
+	case err := <-th.errors:
+		assert.ErrorContains(t, err, "certificate")
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a certificate error")
+	}
+
+	cli.Close()
+
+	// Missing header
+
+	cli = NewClient(&ClientConfig{
+		Url:                  serverUrl,
+		AuthToken:            "test",
+		ErrorHandler:         th,
+		RetryConnectionDelay: 50 * time.Millisecond,
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+	})
+
+	cli.Connect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, cli.WaitUntilConnected(ctx), context.DeadlineExceeded)
+
+	cli.Close()
+
+	// Trusted certificate, headers and proxy
+
+	var proxyCalls atomic.Int32
+
+	cli = NewClient(&ClientConfig{
+		Url:                  serverUrl,
+		AuthToken:            "test",
+		ErrorHandler:         th,
+		RetryConnectionDelay: 50 * time.Millisecond,
+		Dialer: &websocket.Dialer{
+			HandshakeTimeout: 5 * time.Second,
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs: rootCAs,
+		},
+		Headers: http.Header{
+			"X-Test": []string{"test-value"},
+		},
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			proxyCalls.Add(1)
+			return nil, nil // Direct connection
+		},
+	})
+
+	cli.Connect()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, cli.WaitUntilConnected(ctx))
+	assert.Greater(t, proxyCalls.Load(), int32(0))
+
+	cli.Close()
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	// Server accepting TCP connections without responding
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer listener.Close()
+
+	go func() {
+		// Kept open without responding, until the listener is closed
+		connections := make([]net.Conn, 0)
+
+		defer func() {
+			for _, c := range connections {
+				c.Close()
+			}
+		}()
+
+		for {
+			c, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			connections = append(connections, c)
+		}
+	}()
+
+	th := &testConnectionErrorHandler{
+		errors: make(chan error, 1),
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:                  "ws://" + listener.Addr().String(),
+		AuthToken:            "test",
+		ErrorHandler:         th,
+		RetryConnectionDelay: 50 * time.Millisecond,
+		HandshakeTimeout:     100 * time.Millisecond,
+	})
+
+	cli.Connect()
+
+	select {
+	case err := <-th.errors:
+		assert.ErrorContains(t, err, "timeout")
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a timeout error")
+	}
+
+	cli.Close()
+}
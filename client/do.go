@@ -0,0 +1,73 @@
+// Do helper
+
+package prc_client
+
+import "context"
+
+// Runs a function as a request, starting it before calling the function and ending it after the function returns
+// The request is ended even if the function panics, re-raising the panic
+// Parameters:
+// - ctx - Context to cancel the wait for the server response. Also the parent of the context passed to the function
+// - requestType - String to indicate the request type
+// - limit - Máximum number of requests allowed to be run in parallel
+// - fn - Function to run. Its context is cancelled (with ErrLost as the cause) if the slot of the request is lost
+// Returns:
+// - err - The error returned by the function. *LimitedError (ErrLimited) if the limit was reached. Any error of StartRequestContext
+func (cli *Client) Do(ctx context.Context, requestType string, limit uint32, fn func(ctx context.Context) error) (err error) {
+	res, err := cli.StartRequestContext(ctx, requestType, limit)
+
+	if err != nil {
+		return err
+	}
+
+	if res.Limited {
+		return &LimitedError{
+			Frozen:     res.Frozen,
+			Count:      res.Count,
+			Limit:      res.Limit,
+			RetryAfter: res.RetryAfter,
+		}
+	}
+
+	return runStartedRequest(ctx, res.Request, fn)
+}
+
+// Runs a function for a started request, ending the request after the function returns
+// The request is ended even if the function panics, re-raising the panic
+// Parameters:
+// - ctx - Parent of the context passed to the function
+// - request - Started request
+// - fn - Function to run. Its context is cancelled (with ErrLost as the cause) if the slot of the request is lost
+// Returns the error returned by the function
+func runStartedRequest(ctx context.Context, request *StartedRequest, fn func(ctx context.Context) error) (err error) {
+	fnCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Cancel the function context if the slot is lost
+
+	go func() {
+		select {
+		case <-request.Lost():
+			cancel(ErrLost)
+		case <-fnCtx.Done():
+		}
+	}()
+
+	// End the request, even if the function panics
+
+	panicked := true
+
+	defer func() {
+		if panicked {
+			request.EndWithOutcome(false)
+		}
+	}()
+
+	err = fn(fnCtx)
+
+	panicked = false
+
+	request.EndWithOutcome(err == nil)
+
+	return err
+}
@@ -0,0 +1,234 @@
+// Freezing and draining request types
+
+package prc_client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+// Request type or prefix frozen by the client
+type FreezeTarget struct {
+	// Name of the parameter for the target: Request-Type or Request-Type-Prefix
+	param string
+
+	// Request type or prefix
+	target string
+}
+
+// Creates a random ID for the freezes of a connection
+func makeFreezeId() string {
+	id := make([]byte, 16)
+
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Creates a FREEZE or UNFREEZE message
+// Parameters:
+// - method - FREEZE or UNFREEZE
+// - target - Request type or prefix
+// - freezeId - ID of the freezes of the connection. For UNFREEZE, only removes the freeze made with the ID. Empty to remove it for every client
+func makeFreezeMessage(method string, target FreezeTarget, freezeId string) *simple_rpc_message.RPCMessage {
+	params := map[string]string{
+		target.param: target.target,
+	}
+
+	if freezeId != "" {
+		params["Freeze-ID"] = freezeId
+	}
+
+	return &simple_rpc_message.RPCMessage{
+		Method: method,
+		Params: params,
+		Body:   "",
+	}
+}
+
+// Sends a FREEZE or UNFREEZE message and waits for the ACK
+// Request types are sent to the shard owning them. Prefixes are sent to every shard
+func (cli *Client) sendFreezeMessage(method string, targetParam string, target string) error {
+	if target == "" {
+		return ErrInvalidRequestType
+	}
+
+	freezeTarget := FreezeTarget{
+		param:  targetParam,
+		target: target,
+	}
+
+	if method == "UNFREEZE" {
+		// Stop sending the freeze on connection, regardless of the connection that sent it
+
+		for _, conn := range cli.connections {
+			conn.RemoveFreeze(freezeTarget)
+		}
+	}
+
+	if targetParam == "Request-Type" {
+		_, err := cli.sendShardFreezeMessage(cli.getShard(target), method, freezeTarget)
+		return err
+	}
+
+	frozen := make([]*Connection, 0, len(cli.shards))
+
+	for _, shard := range cli.shards {
+		conn, err := cli.sendShardFreezeMessage(shard, method, freezeTarget)
+
+		if err != nil {
+			if method == "FREEZE" {
+				// Roll back, so the prefix is not left frozen in only some shards
+				for _, frozenConn := range frozen {
+					cli.releaseShardFreeze(frozenConn, freezeTarget)
+				}
+			}
+
+			return err
+		}
+
+		frozen = append(frozen, conn)
+	}
+
+	return nil
+}
+
+// Sends a FREEZE or UNFREEZE message to a shard and waits for the ACK
+// Returns the connection used to send the message
+func (cli *Client) sendShardFreezeMessage(shard *Shard, method string, target FreezeTarget) (*Connection, error) {
+	conn, _ := cli.getAvailableConnectionFromPool(shard)
+
+	freezeId := ""
+
+	if method == "FREEZE" {
+		// The server keeps the freeze for a while if the connection is closed, so it can be resumed on connection
+		freezeId = conn.freezeId
+	}
+
+	ctx, cancel := cli.withTimeout(context.Background())
+	defer cancel()
+
+	_, err := cli.sendQuery(ctx, conn, makeFreezeMessage(method, target, freezeId))
+
+	if err != nil {
+		return conn, queryError(context.Background(), conn, err)
+	}
+
+	if method == "FREEZE" {
+		conn.AddFreeze(target)
+	}
+
+	return conn, nil
+}
+
+// Removes a freeze made by a connection, without removing the freezes made by other clients
+func (cli *Client) releaseShardFreeze(conn *Connection, target FreezeTarget) {
+	conn.RemoveFreeze(target)
+
+	ctx, cancel := cli.withTimeout(context.Background())
+	defer cancel()
+
+	cli.sendQuery(ctx, conn, makeFreezeMessage("UNFREEZE", target, conn.freezeId))
+}
+
+// Freezes a request type. Every new request of the type will be rejected as limited, until unfrozen
+// The requests already started are not affected
+// The freeze is bound to the client: the server removes it if the client is closed,
+// or if it stays disconnected longer than the release delay of the server
+// Parameters:
+// - requestType - String to indicate the request type
+// Returns:
+// - err - An error that prevented the freeze from completing
+func (cli *Client) Freeze(requestType string) error {
+	return cli.sendFreezeMessage("FREEZE", "Request-Type", requestType)
+}
+
+// Unfreezes a request type, previously frozen with Freeze
+// Parameters:
+// - requestType - String to indicate the request type
+// Returns:
+// - err - An error that prevented the unfreeze from completing
+func (cli *Client) Unfreeze(requestType string) error {
+	return cli.sendFreezeMessage("UNFREEZE", "Request-Type", requestType)
+}
+
+// Freezes every request type starting with a prefix
+// Parameters:
+// - prefix - Request type prefix
+// Returns:
+// - err - An error that prevented the freeze from completing
+func (cli *Client) FreezePrefix(prefix string) error {
+	return cli.sendFreezeMessage("FREEZE", "Request-Type-Prefix", prefix)
+}
+
+// Unfreezes a request type prefix, previously frozen with FreezePrefix
+// Parameters:
+// - prefix - Request type prefix
+// Returns:
+// - err - An error that prevented the unfreeze from completing
+func (cli *Client) UnfreezePrefix(prefix string) error {
+	return cli.sendFreezeMessage("UNFREEZE", "Request-Type-Prefix", prefix)
+}
+
+// Waits until there are no requests of a type being handled
+// Usually called after Freeze, in order to wait for the requests in progress to finish
+// Parameters:
+// - ctx - Context to cancel the wait. If it has a deadline, the server is told to give up at the same time
+// - requestType - String to indicate the request type
+// Returns:
+// - err - An error that prevented the request type from draining. The context error if cancelled
+func (cli *Client) WaitDrained(ctx context.Context, requestType string) error {
+	if requestType == "" {
+		return ErrInvalidRequestType
+	}
+
+	conn, _ := cli.getAvailableConnectionFromPool(cli.getShard(requestType))
+
+	params := map[string]string{
+		"Request-Type": requestType,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		params["Timeout"] = fmt.Sprint(max(time.Until(deadline).Milliseconds(), 1))
+	}
+
+	msg := &simple_rpc_message.RPCMessage{
+		Method: "WAIT-DRAINED",
+		Params: params,
+		Body:   "",
+	}
+
+	reply, err := cli.sendQuery(ctx, conn, msg)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			if msg.GetParam("Query-ID") != "" {
+				// Tell the server to stop waiting
+				conn.Send(&simple_rpc_message.RPCMessage{
+					Method: "CANCEL-WAIT-DRAINED",
+					Params: map[string]string{
+						"Query-ID": msg.GetParam("Query-ID"),
+					},
+					Body: "",
+				})
+			}
+
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	if strings.ToUpper(reply.GetParam("Drained")) != "TRUE" {
+		// The server timeout is the deadline of the context
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+// Endpoint selection
+
+package prc_client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategy to select the endpoint to connect to
+type EndpointStrategy int
+
+const (
+	// Connect to the first endpoint of the list that is not marked down (default)
+	EndpointStrategyPrimaryBackup EndpointStrategy = iota
+
+	// Connect to a random endpoint that is not marked down
+	EndpointStrategyRandom
+)
+
+// Selects the endpoints for the connections of a client
+type EndpointSelector struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// List of endpoints
+	endpoints []string
+
+	// Selection strategy
+	strategy EndpointStrategy
+
+	// Time a failed endpoint stays marked down
+	backoff time.Duration
+
+	// Map (Endpoint) -> Time it stops being marked down
+	downUntil map[string]time.Time
+}
+
+// Creates endpoint selector
+func NewEndpointSelector(endpoints []string, strategy EndpointStrategy, backoff time.Duration) *EndpointSelector {
+	return &EndpointSelector{
+		mu:        &sync.Mutex{},
+		endpoints: endpoints,
+		strategy:  strategy,
+		backoff:   backoff,
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+// Gets the endpoints not marked down
+// If every endpoint is marked down, returns all of them
+func (es *EndpointSelector) getCandidates(now time.Time) []string {
+	candidates := make([]string, 0, len(es.endpoints))
+
+	for _, endpoint := range es.endpoints {
+		if until, ok := es.downUntil[endpoint]; ok && now.Before(until) {
+			continue
+		}
+
+		candidates = append(candidates, endpoint)
+	}
+
+	if len(candidates) == 0 {
+		return es.endpoints
+	}
+
+	return candidates
+}
+
+// Selects the endpoint to connect to
+func (es *EndpointSelector) Next() string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	candidates := es.getCandidates(time.Now())
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	if es.strategy == EndpointStrategyRandom {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	return candidates[0]
+}
+
+// Marks an endpoint as down, so it is not selected until the backoff period ends
+func (es *EndpointSelector) MarkDown(endpoint string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	es.downUntil[endpoint] = time.Now().Add(es.backoff)
+}
+
+// Marks an endpoint as up, after connecting to it
+func (es *EndpointSelector) MarkUp(endpoint string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	delete(es.downUntil, endpoint)
+}
+
+// Checks if any endpoint is not marked down
+func (es *EndpointSelector) HasAvailable() bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	now := time.Now()
+
+	for _, endpoint := range es.endpoints {
+		if until, ok := es.downUntil[endpoint]; !ok || !now.Before(until) {
+			return true
+		}
+	}
+
+	return false
+}
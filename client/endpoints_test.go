@@ -0,0 +1,49 @@
+// Endpoint selection test
+
+package prc_client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointSelector(t *testing.T) {
+	// Primary / backup
+
+	es := NewEndpointSelector([]string{"ws://a", "ws://b", "ws://c"}, EndpointStrategyPrimaryBackup, 100*time.Millisecond)
+
+	assert.Equal(t, es.Next(), "ws://a")
+
+	es.MarkDown("ws://a")
+
+	assert.Equal(t, es.Next(), "ws://b")
+	assert.True(t, es.HasAvailable())
+
+	es.MarkDown("ws://b")
+	es.MarkDown("ws://c")
+
+	assert.False(t, es.HasAvailable())
+	assert.Equal(t, es.Next(), "ws://a")
+
+	es.MarkUp("ws://c")
+
+	assert.Equal(t, es.Next(), "ws://c")
+
+	// The backoff period ends
+
+	time.Sleep(150 * time.Millisecond)
+
+	assert.Equal(t, es.Next(), "ws://a")
+
+	// Random
+
+	es = NewEndpointSelector([]string{"ws://a", "ws://b", "ws://c"}, EndpointStrategyRandom, time.Minute)
+
+	es.MarkDown("ws://b")
+
+	for i := 0; i < 20; i++ {
+		assert.NotEqual(t, es.Next(), "ws://b")
+	}
+}
@@ -7,6 +7,7 @@ type ErrorHandler interface {
 	// Called on connection error. The client will retry the connection if not manually closed
 	OnConnectionError(err error)
 
-	// Called when an ERROR message is received from the server
+	// Called when an ERROR message is received from the server.
+	// Errors related to a call waiting for a response are returned by the call instead (as *ServerError)
 	OnServerError(code string, message string)
 }
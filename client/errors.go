@@ -0,0 +1,77 @@
+// Errors
+
+package prc_client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error returned when the server did not respond in time
+var ErrTimeout = errors.New("timeout")
+
+// Error returned when the server did not respond in time, and the connection was not established during the wait
+var ErrNotConnected = errors.New("not connected to the parallel request controller")
+
+// Error returned when the client was closed
+var ErrClosed = errors.New("client closed")
+
+// Error returned when the request type is not valid
+var ErrInvalidRequestType = errors.New("invalid request type")
+
+// Error returned by StartRequestByName when the request type has no limit in the registry
+var ErrUnknownRequestType = errors.New("unknown request type: no limit configured")
+
+// Error returned when the server sent a response that could not be understood
+var ErrInvalidResponse = errors.New("invalid response received from the server")
+
+// Error returned when the parallel request controller is unreachable and the policy is UnavailablePolicyFailFast
+var ErrUnavailable = errors.New("parallel request controller unavailable")
+
+// Error returned by Do when the limit was reached. Use errors.As with *LimitedError to get the details
+var ErrLimited = errors.New("parallel request limit reached")
+
+// Cause of the cancellation of the context passed to the function by Do, when the slot of the request is lost
+var ErrLost = errors.New("request slot lost")
+
+// Error returned by Do when the limit was reached
+type LimitedError struct {
+	// True if the request type is frozen
+	Frozen bool
+
+	// Number of requests of the type being handled
+	Count uint32
+
+	// Limit enforced by the server
+	Limit uint32
+
+	// Estimated time until a request of the type can be started. 0 if unknown
+	RetryAfter time.Duration
+}
+
+func (err *LimitedError) Error() string {
+	if err.Frozen {
+		return ErrLimited.Error() + ": request type frozen"
+	}
+
+	return fmt.Sprintf("%s: %d of %d", ErrLimited.Error(), err.Count, err.Limit)
+}
+
+// Makes errors.Is(err, ErrLimited) return true
+func (err *LimitedError) Is(target error) bool {
+	return target == ErrLimited
+}
+
+// Error sent by the server (ERROR message) in response to a call
+type ServerError struct {
+	// Error code
+	Code string
+
+	// Error message
+	Message string
+}
+
+func (err *ServerError) Error() string {
+	return "server error: " + err.Code + ": " + err.Message
+}
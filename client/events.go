@@ -0,0 +1,124 @@
+// Connection lifecycle events
+
+package prc_client
+
+import "context"
+
+// State of the client
+type ClientState int
+
+const (
+	// Not connecting. Connect was not called, or the client was closed
+	ClientStateDisconnected ClientState = iota
+
+	// Connecting. No connection is established yet
+	ClientStateConnecting
+
+	// Connected. At least one connection is established
+	ClientStateConnected
+)
+
+// Gets the name of the state
+func (state ClientState) String() string {
+	switch state {
+	case ClientStateConnecting:
+		return "connecting"
+	case ClientStateConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// Connection lifecycle event
+type ConnectionEvent struct {
+	// Identifier of the shard of the connection
+	ShardId string
+
+	// Index of the connection in the pool of the shard
+	ConnectionIndex int
+
+	// Endpoint (base URL) of the connection
+	Url string
+
+	// Error that caused the disconnection. Nil if the connection was closed by the client
+	Err error
+}
+
+// Handler for the connection lifecycle events.
+// The methods are called from the connection goroutine, so they should not block.
+type ConnectionEventHandler interface {
+	// Called when a connection is established for the first time
+	OnConnected(event ConnectionEvent)
+
+	// Called when an established connection is lost or closed
+	OnDisconnected(event ConnectionEvent)
+
+	// Called when a connection is established again after being lost
+	OnReconnected(event ConnectionEvent)
+}
+
+// Gets the state of the client
+func (cli *Client) State() ClientState {
+	cli.mu.Lock()
+
+	liveConnections := cli.liveConnections
+
+	cli.mu.Unlock()
+
+	if liveConnections > 0 {
+		return ClientStateConnected
+	}
+
+	for _, conn := range cli.connections {
+		if !conn.IsClosed() {
+			return ClientStateConnecting
+		}
+	}
+
+	return ClientStateDisconnected
+}
+
+// Waits until at least one connection is established
+// Parameters:
+// - ctx - The context. Cancel it to stop waiting.
+// Returns the context error if the context finished before connecting, or ErrClosed if the client was closed
+func (cli *Client) WaitUntilConnected(ctx context.Context) error {
+	for {
+		cli.mu.Lock()
+
+		if cli.liveConnections > 0 {
+			cli.mu.Unlock()
+			return nil
+		}
+
+		if cli.closed {
+			cli.mu.Unlock()
+			return ErrClosed
+		}
+
+		stateChanged := cli.stateChanged
+		closedChan := cli.closedChan
+
+		cli.mu.Unlock()
+
+		select {
+		case <-stateChanged:
+		case <-closedChan:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Updates the number of established connections, waking up the callers of WaitUntilConnected
+func (cli *Client) onConnectionStateChanged(delta int) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	cli.liveConnections += delta
+
+	close(cli.stateChanged)
+	cli.stateChanged = make(chan struct{})
+}
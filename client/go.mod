@@ -4,13 +4,19 @@ go 1.22.0
 
 require (
 	github.com/AgustinSRG/go-simple-rpc-message v1.0.1
+	github.com/AgustinSRG/parallel-request-controller/server v1.1.0
 	github.com/gorilla/websocket v1.5.3
-	github.com/joho/godotenv v1.5.1
 	github.com/stretchr/testify v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/rogpeppe/go-internal v1.10.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
+
+// Server of the repository, for the tests and prctest. Dependents ignore it and use the required release
+replace github.com/AgustinSRG/parallel-request-controller/server => ../server
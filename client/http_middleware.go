@@ -0,0 +1,110 @@
+// HTTP middleware
+
+package prc_client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// Default status code sent by the HTTP middleware when the controller is unreachable
+const DEFAULT_HTTP_UNAVAILABLE_STATUS = http.StatusServiceUnavailable
+
+// Min value of the Retry-After header sent by the HTTP middleware when the limit is reached
+const MIN_HTTP_RETRY_AFTER_SECONDS = 1
+
+// Function to get the request type and the limit for an HTTP request
+// Return an empty request type in order to not limit the request
+type HttpRequestTypeFunc func(req *http.Request) (requestType string, limit uint32)
+
+// Configuration of the HTTP middleware
+type HttpMiddlewareConfig struct {
+	// Client for the parallel request controller
+	Client *Client
+
+	// Function to get the request type and the limit for each request
+	RequestType HttpRequestTypeFunc
+
+	// Status code sent when the controller cannot be reached. By default: 503
+	UnavailableStatus int
+}
+
+// HTTP middleware to limit the parallel requests of an HTTP handler
+type HttpMiddleware struct {
+	// Configuration
+	config HttpMiddlewareConfig
+
+	// Next handler
+	next http.Handler
+}
+
+// Creates HTTP middleware
+// Parameters:
+// - config - Configuration of the middleware
+// - next - Handler to call if the request is not limited
+// Returns the handler to serve the requests
+func NewHttpMiddleware(config HttpMiddlewareConfig, next http.Handler) *HttpMiddleware {
+	if config.UnavailableStatus == 0 {
+		config.UnavailableStatus = DEFAULT_HTTP_UNAVAILABLE_STATUS
+	}
+
+	return &HttpMiddleware{
+		config: config,
+		next:   next,
+	}
+}
+
+// Serves HTTP request
+// Responds with 429 if the limit was reached, calling the next handler otherwise
+func (middleware *HttpMiddleware) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	requestType, limit := middleware.config.RequestType(req)
+
+	if requestType == "" {
+		middleware.next.ServeHTTP(w, req)
+		return
+	}
+
+	res, err := middleware.config.Client.StartRequestContext(req.Context(), requestType, limit)
+
+	if err != nil {
+		middleware.writeError(w, req, err)
+		return
+	}
+
+	if res.Limited {
+		// Always sent, so the clients do not retry right away when the server has no estimate
+		retryAfter := max(int64(math.Ceil(res.RetryAfter.Seconds())), MIN_HTTP_RETRY_AFTER_SECONDS)
+
+		w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Too many requests.")
+		return
+	}
+
+	// Ended even if the handler panics
+	defer res.Request.End()
+
+	middleware.next.ServeHTTP(w, req)
+}
+
+// Responds to an HTTP request that could not be started
+// Only the errors reaching the controller are responded with UnavailableStatus
+func (middleware *HttpMiddleware) writeError(w http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		// The client is gone, so nobody reads the response
+		return
+	}
+
+	if errors.Is(err, ErrNotConnected) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrClosed) {
+		w.WriteHeader(middleware.config.UnavailableStatus)
+		fmt.Fprint(w, "Service unavailable.")
+		return
+	}
+
+	// Invalid request types or unknown errors
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprint(w, "Internal server error.")
+}
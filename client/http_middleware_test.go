@@ -0,0 +1,208 @@
+// HTTP middleware test
+
+package prc_client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AgustinSRG/parallel-request-controller/client/internal/testserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForRequestCount(t *testing.T, cli *Client, rType string, expected uint32) {
+	timeout := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(timeout) {
+		count, err := cli.GetRequestCount(rType)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if count == expected {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Timed out waiting for count %d", expected)
+}
+
+func TestHttpMiddleware(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-http-type"
+	unblock := make(chan struct{})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/block":
+			<-unblock
+		case "/panic":
+			panic(http.ErrAbortHandler)
+		}
+
+		w.WriteHeader(200)
+	})
+
+	server := httptest.NewServer(NewHttpMiddleware(HttpMiddlewareConfig{
+		Client: cli,
+		RequestType: func(req *http.Request) (string, uint32) {
+			if req.URL.Path == "/skip" {
+				return "", 0
+			}
+
+			return rType, 1
+		},
+	}, handler))
+	defer server.Close()
+
+	// Block the only slot
+
+	blockedDone := make(chan int)
+
+	go func() {
+		res, err := http.Get(server.URL + "/block")
+
+		if err != nil {
+			t.Error(err)
+			blockedDone <- 0
+			return
+		}
+
+		res.Body.Close()
+		blockedDone <- res.StatusCode
+	}()
+
+	waitForRequestCount(t, cli, rType, 1)
+
+	res, err := http.Get(server.URL + "/")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res.Body.Close()
+
+	assert.Equal(t, res.StatusCode, http.StatusTooManyRequests)
+	assert.Equal(t, res.Header.Get("Retry-After"), "1")
+
+	// Not limited
+
+	res, err = http.Get(server.URL + "/skip")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res.Body.Close()
+
+	assert.Equal(t, res.StatusCode, 200)
+
+	// Release the slot
+
+	close(unblock)
+
+	assert.Equal(t, <-blockedDone, 200)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// The slot is released on panic
+
+	_, err = http.Get(server.URL + "/panic")
+
+	assert.Error(t, err)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	cli.Close()
+}
+
+func TestHttpMiddlewareUnavailable(t *testing.T) {
+	// Client never connected
+	cli := NewClient(&ClientConfig{
+		Url:     "ws://localhost:1",
+		Timeout: 100 * time.Millisecond,
+	})
+
+	server := httptest.NewServer(NewHttpMiddleware(HttpMiddlewareConfig{
+		Client: cli,
+		RequestType: func(req *http.Request) (string, uint32) {
+			return "test-http-unavailable-type", 1
+		},
+		UnavailableStatus: http.StatusBadGateway,
+	}, http.NotFoundHandler()))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res.Body.Close()
+
+	assert.Equal(t, res.StatusCode, http.StatusBadGateway)
+}
+
+func TestHttpMiddlewareErrors(t *testing.T) {
+	server := testserver.NewServer()
+	defer server.Close()
+
+	cli := NewClient(&ClientConfig{
+		Url:       server.Url(),
+		AuthToken: server.AuthToken(),
+	})
+
+	cli.Connect()
+	defer cli.Close()
+
+	handler := NewHttpMiddleware(HttpMiddlewareConfig{
+		Client: cli,
+		RequestType: func(req *http.Request) (string, uint32) {
+			return "test-http-errors-type", 1
+		},
+		UnavailableStatus: http.StatusBadGateway,
+	}, http.NotFoundHandler())
+
+	// Errors replied by the controller are not reported as unavailable
+
+	server.SetFault("START-REQUEST", "INTERNAL_ERROR", "Test error")
+
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, rec.Code, http.StatusInternalServerError)
+
+	// Nothing is written if the client is gone
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec = httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	assert.False(t, rec.Flushed)
+	assert.Equal(t, rec.Body.Len(), 0)
+}
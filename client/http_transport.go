@@ -0,0 +1,217 @@
+// HTTP transport
+
+package prc_client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Min delay to retry an outbound request when the limit is reached (WaitWhenLimited)
+const HTTP_TRANSPORT_MIN_BACKOFF = 10 * time.Millisecond
+
+// Max delay to retry an outbound request when the limit is reached (WaitWhenLimited)
+const HTTP_TRANSPORT_MAX_BACKOFF = time.Second
+
+// Configuration of the HTTP transport
+type HttpTransportConfig struct {
+	// Client for the parallel request controller
+	Client *Client
+
+	// Function to get the request type and the limit for each outbound request
+	RequestType HttpRequestTypeFunc
+
+	// Transport used to send the requests. By default: http.DefaultTransport
+	Base http.RoundTripper
+
+	// True to wait until the limit allows the request, or the request context finishes.
+	// By default, RoundTrip fails immediately with *LimitedError (ErrLimited)
+	WaitWhenLimited bool
+}
+
+// HTTP transport (http.RoundTripper) to limit the parallel outbound requests, for every client
+// The request is ended when the response body is closed
+type HttpTransport struct {
+	// Configuration
+	config HttpTransportConfig
+}
+
+// Creates HTTP transport
+// Parameters:
+// - config - Configuration of the transport
+// Returns the transport, to be used as the Transport of an http.Client
+func NewHttpTransport(config HttpTransportConfig) *HttpTransport {
+	if config.Base == nil {
+		config.Base = http.DefaultTransport
+	}
+
+	return &HttpTransport{
+		config: config,
+	}
+}
+
+// Gets a function to use the host of the outbound request as the request type
+// Parameters:
+// - limit - Limit for every host
+func HttpRequestTypeByHost(limit uint32) HttpRequestTypeFunc {
+	return func(req *http.Request) (string, uint32) {
+		return req.URL.Host, limit
+	}
+}
+
+// Gets a function to use the host and the path template of the outbound request as the request type
+// In the templates, a segment between braces matches any segment. Example: /users/{id}/files
+// Requests not matching any template use the host as the request type
+// Parameters:
+// - limit - Limit for every host and template
+// - templates - List of path templates
+func HttpRequestTypeByPathTemplate(limit uint32, templates ...string) HttpRequestTypeFunc {
+	return func(req *http.Request) (string, uint32) {
+		for _, template := range templates {
+			if matchPathTemplate(template, req.URL.Path) {
+				return req.URL.Host + template, limit
+			}
+		}
+
+		return req.URL.Host, limit
+	}
+}
+
+// Checks if a path matches a template
+// A segment between braces in the template matches any segment
+func matchPathTemplate(template string, path string) bool {
+	templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+
+	if len(templateSegments) != len(pathSegments) {
+		return false
+	}
+
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if pathSegments[i] == "" {
+				return false
+			}
+
+			continue
+		}
+
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sends an outbound HTTP request, if the limit allows it
+// Returns *LimitedError (ErrLimited) if the limit was reached and WaitWhenLimited is false,
+// or any error of StartRequestContext
+func (transport *HttpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestType, limit := transport.config.RequestType(req)
+
+	if requestType == "" {
+		return transport.config.Base.RoundTrip(req)
+	}
+
+	request, err := transport.startRequest(req, requestType, limit)
+
+	if err != nil {
+		// The body must be closed, even if the request is not sent
+		if req.Body != nil {
+			req.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	res, err := transport.config.Base.RoundTrip(req)
+
+	if err != nil {
+		request.EndWithOutcome(false)
+		return nil, err
+	}
+
+	body := &httpTransportBody{
+		ReadCloser: res.Body,
+		request:    request,
+		success:    res.StatusCode < http.StatusInternalServerError,
+	}
+
+	if writer, ok := res.Body.(io.Writer); ok {
+		// Keep the body writable (101 Switching Protocols)
+		res.Body = &httpTransportReadWriteBody{
+			httpTransportBody: body,
+			Writer:            writer,
+		}
+	} else {
+		res.Body = body
+	}
+
+	return res, nil
+}
+
+// Starts the request for an outbound HTTP request
+// If WaitWhenLimited is true, retries with exponential backoff until started
+func (transport *HttpTransport) startRequest(req *http.Request, requestType string, limit uint32) (*StartedRequest, error) {
+	ctx := req.Context()
+	backoff := HTTP_TRANSPORT_MIN_BACKOFF
+
+	for {
+		res, err := transport.config.Client.StartRequestContext(ctx, requestType, limit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !res.Limited {
+			return res.Request, nil
+		}
+
+		if !transport.config.WaitWhenLimited {
+			return nil, &LimitedError{
+				Frozen:     res.Frozen,
+				Count:      res.Count,
+				Limit:      res.Limit,
+				RetryAfter: res.RetryAfter,
+			}
+		}
+
+		err = waitBackoff(ctx, backoff, res.RetryAfter, HTTP_TRANSPORT_MAX_BACKOFF)
+
+		if err != nil {
+			return nil, err
+		}
+
+		backoff = min(backoff*2, HTTP_TRANSPORT_MAX_BACKOFF)
+	}
+}
+
+// Body of a response received by the HTTP transport
+// Ends the request when closed, reporting a failure for 5xx responses
+type httpTransportBody struct {
+	io.ReadCloser
+
+	// Request started for the outbound request
+	request *StartedRequest
+
+	// Outcome of the request
+	success bool
+}
+
+func (body *httpTransportBody) Close() error {
+	err := body.ReadCloser.Close()
+
+	body.request.EndWithOutcome(body.success)
+
+	return err
+}
+
+// Writable body of a response received by the HTTP transport
+type httpTransportReadWriteBody struct {
+	*httpTransportBody
+
+	io.Writer
+}
@@ -0,0 +1,167 @@
+// HTTP transport test
+
+package prc_client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPathTemplate(t *testing.T) {
+	assert.True(t, matchPathTemplate("/users/{id}", "/users/1"))
+	assert.True(t, matchPathTemplate("/users/{id}/files", "/users/1/files/"))
+	assert.False(t, matchPathTemplate("/users/{id}", "/users/1/files"))
+	assert.False(t, matchPathTemplate("/users/{id}", "/users/"))
+	assert.False(t, matchPathTemplate("/users/{id}", "/groups/1"))
+}
+
+func TestHttpTransport(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	rType := "test-http-transport-type"
+
+	httpClient := &http.Client{
+		Transport: NewHttpTransport(HttpTransportConfig{
+			Client: cli,
+			RequestType: func(req *http.Request) (string, uint32) {
+				if req.URL.Path == "/skip" {
+					return "", 0
+				}
+
+				return rType, 1
+			},
+		}),
+	}
+
+	// The slot is kept until the body is closed
+
+	res, err := httpClient.Get(upstream.URL + "/")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, res.StatusCode, 200)
+
+	waitForRequestCount(t, cli, rType, 1)
+
+	_, err = httpClient.Get(upstream.URL + "/")
+
+	var limitedErr *LimitedError
+
+	assert.True(t, errors.As(err, &limitedErr))
+	assert.Equal(t, limitedErr.Limit, uint32(1))
+
+	// Not limited
+
+	res2, err := httpClient.Get(upstream.URL + "/skip")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res2.Body.Close()
+
+	// Release the slot
+
+	res.Body.Close()
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Wait when limited
+
+	waitingClient := &http.Client{
+		Transport: NewHttpTransport(HttpTransportConfig{
+			Client:          cli,
+			RequestType:     HttpRequestTypeByPathTemplate(1, "/users/{id}"),
+			WaitWhenLimited: true,
+		}),
+	}
+
+	rType = upstream.Listener.Addr().String() + "/users/{id}"
+
+	res, err = waitingClient.Get(upstream.URL + "/users/1")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	waitForRequestCount(t, cli, rType, 1)
+
+	waitDone := make(chan error)
+
+	go func() {
+		res, err := waitingClient.Get(upstream.URL + "/users/2")
+
+		if err == nil {
+			res.Body.Close()
+		}
+
+		waitDone <- err
+	}()
+
+	select {
+	case <-waitDone:
+		t.Error("Request sent while limited")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res.Body.Close()
+
+	select {
+	case err = <-waitDone:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the limited request")
+	}
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// The wait ends with the request context
+
+	res, err = waitingClient.Get(upstream.URL + "/users/1")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL+"/users/2", nil)
+
+	_, err = waitingClient.Do(req)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	res.Body.Close()
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	cli.Close()
+}
@@ -0,0 +1,362 @@
+// In-process test server
+// Used by prctest and by the tests of the client, which cannot import prctest
+
+package testserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+	"github.com/AgustinSRG/parallel-request-controller/server/prc_server"
+	"github.com/gorilla/websocket"
+)
+
+// Auth token of the test servers
+const TEST_AUTH_TOKEN = "test-auth-token"
+
+// Error to reply instead of forwarding a message to the server
+type Fault struct {
+	// Error code
+	Code string
+
+	// Error message
+	Message string
+}
+
+// Parallel request controller server running in the process, for tests
+// The clients connect to a proxy in front of the server, used to inject faults
+type Server struct {
+	// Server running the parallel request controller
+	backend *httptest.Server
+
+	// Proxy the clients connect to
+	front *httptest.Server
+
+	// Request controller of the server
+	requestController *prc_server.RequestController
+
+	// Websocket connection upgrader
+	upgrader *websocket.Upgrader
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Connections through the proxy
+	connections map[*proxyConnection]bool
+
+	// Delay to apply to the START-REQUEST-ACK messages
+	ackDelay time.Duration
+
+	// Map (Method) -> Error to reply for the messages of the method
+	faults map[string]Fault
+}
+
+// Starts a test server
+// Call Close when no longer needed
+func NewServer() *Server {
+	requestController := prc_server.CreateRequestController()
+
+	server := &Server{
+		requestController: requestController,
+		upgrader:          &websocket.Upgrader{},
+		mu:                &sync.Mutex{},
+		connections:       make(map[*proxyConnection]bool),
+		faults:            make(map[string]Fault),
+	}
+
+	// Default options, so forced requests are limited as in a server with the default configuration
+
+	server.backend = httptest.NewServer(prc_server.CreateHttpServer(prc_server.HttpServerOptions{
+		AuthToken:         TEST_AUTH_TOKEN,
+		Logger:            prc_server.DiscardLogger{},
+		RequestController: requestController,
+	}).Handler())
+
+	server.front = httptest.NewServer(server)
+
+	return server
+}
+
+// Gets the base URL to connect to the server. Example: ws://127.0.0.1:1234
+func (server *Server) Url() string {
+	return "ws" + strings.TrimPrefix(server.front.URL, "http")
+}
+
+// Gets the auth token of the server
+func (server *Server) AuthToken() string {
+	return TEST_AUTH_TOKEN
+}
+
+// Gets the request controller of the server, to inspect or change its state
+func (server *Server) RequestController() *prc_server.RequestController {
+	return server.requestController
+}
+
+// Gets the number of requests of a type being handled by the server
+func (server *Server) RequestCount(requestType string) uint32 {
+	return server.requestController.GetRequestCount(requestType)
+}
+
+// Waits for the number of requests of a type to reach a value
+// Parameters:
+// - requestType - Request type
+// - expected - Expected number of requests
+// - timeout - Max time to wait
+// Returns true if the value was reached before the timeout
+func (server *Server) WaitForRequestCount(requestType string, expected uint32, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if server.RequestCount(requestType) == expected {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Gets the number of clients connected
+func (server *Server) ConnectionCount() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return len(server.connections)
+}
+
+// Drops the connections of every client
+// The server releases their requests, and the clients reconnect
+func (server *Server) DropConnections() {
+	server.mu.Lock()
+
+	connections := make([]*proxyConnection, 0, len(server.connections))
+
+	for pc := range server.connections {
+		connections = append(connections, pc)
+	}
+
+	server.mu.Unlock()
+
+	for _, pc := range connections {
+		pc.close()
+	}
+}
+
+// Delays the START-REQUEST-ACK messages sent to the clients
+// The messages sent after an ACK are delayed too, in order to keep the order
+// Parameters:
+// - delay - Delay. 0 to stop delaying the messages
+func (server *Server) SetAckDelay(delay time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.ackDelay = delay
+}
+
+// Replies to every message of a method with an ERROR message, instead of forwarding it to the server
+// Parameters:
+// - method - Message method. Example: START-REQUEST
+// - code - Error code
+// - message - Error message
+func (server *Server) SetFault(method string, code string, message string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.faults[strings.ToUpper(method)] = Fault{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Removes the faults, forwarding every message to the server
+// The delay of the START-REQUEST-ACK messages is kept. Call SetAckDelay(0) to remove it
+func (server *Server) ClearFaults() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.faults = make(map[string]Fault)
+}
+
+// Stops the server, dropping the connections of every client
+func (server *Server) Close() {
+	server.DropConnections()
+
+	server.front.Close()
+	server.backend.Close()
+}
+
+// Gets the delay to apply to the START-REQUEST-ACK messages
+func (server *Server) getAckDelay() time.Duration {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.ackDelay
+}
+
+// Gets the fault for a message method, if any
+func (server *Server) getFault(method string) (Fault, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	fault, ok := server.faults[method]
+
+	return fault, ok
+}
+
+// Serves HTTP request, proxying it to the server
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !websocket.IsWebSocketUpgrade(req) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Connect to the server first, so its response (403, ...) is sent to the client
+
+	backendConn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.backend.URL, "http")+req.URL.RequestURI(), nil)
+
+	if err != nil {
+		if res != nil {
+			w.WriteHeader(res.StatusCode)
+		} else {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+
+		return
+	}
+
+	clientConn, err := server.upgrader.Upgrade(w, req, nil)
+
+	if err != nil {
+		backendConn.Close()
+		return
+	}
+
+	pc := &proxyConnection{
+		server:    server,
+		client:    clientConn,
+		backend:   backendConn,
+		muClient:  &sync.Mutex{},
+		closeOnce: &sync.Once{},
+	}
+
+	server.mu.Lock()
+	server.connections[pc] = true
+	server.mu.Unlock()
+
+	go pc.forwardToServer()
+	go pc.forwardToClient()
+}
+
+// Connection of a client through the proxy
+type proxyConnection struct {
+	// Test server
+	server *Server
+
+	// Connection with the client
+	client *websocket.Conn
+
+	// Connection with the server
+	backend *websocket.Conn
+
+	// Mutex to write into the client connection
+	muClient *sync.Mutex
+
+	// Ensures the connection is closed only once
+	closeOnce *sync.Once
+}
+
+// Closes both connections
+func (pc *proxyConnection) close() {
+	pc.closeOnce.Do(func() {
+		pc.client.Close()
+		pc.backend.Close()
+
+		pc.server.mu.Lock()
+		delete(pc.server.connections, pc)
+		pc.server.mu.Unlock()
+	})
+}
+
+// Sends a message to the client
+func (pc *proxyConnection) sendToClient(data []byte) {
+	pc.muClient.Lock()
+	defer pc.muClient.Unlock()
+
+	pc.client.WriteMessage(websocket.TextMessage, data)
+}
+
+// Forwards the messages of the client to the server, replying with the faults
+func (pc *proxyConnection) forwardToServer() {
+	defer pc.close()
+
+	for {
+		_, data, err := pc.client.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		msg := simple_rpc_message.ParseRPCMessage(string(data))
+
+		if fault, ok := pc.server.getFault(msg.Method); ok {
+			params := map[string]string{
+				"Error-Code":    fault.Code,
+				"Error-Message": fault.Message,
+			}
+
+			if requestId := msg.GetParam("Request-ID"); requestId != "" {
+				params["Request-ID"] = requestId
+			}
+
+			if queryId := msg.GetParam("Query-ID"); queryId != "" {
+				params["Query-ID"] = queryId
+			}
+
+			reply := simple_rpc_message.RPCMessage{
+				Method: "ERROR",
+				Params: params,
+				Body:   "",
+			}
+
+			pc.sendToClient([]byte(reply.Serialize()))
+
+			continue
+		}
+
+		err = pc.backend.WriteMessage(websocket.TextMessage, data)
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Forwards the messages of the server to the client, applying the delays
+func (pc *proxyConnection) forwardToClient() {
+	defer pc.close()
+
+	for {
+		_, data, err := pc.backend.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		msg := simple_rpc_message.ParseRPCMessage(string(data))
+
+		if msg.Method == "START-REQUEST-ACK" {
+			if delay := pc.server.getAckDelay(); delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+
+		pc.sendToClient(data)
+	}
+}
@@ -0,0 +1,258 @@
+// Limit registry
+
+package prc_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Limit rule for the request types matching a pattern
+type LimitRule struct {
+	// Request type pattern. The character '*' matches any sequence of characters.
+	// Example: download-*
+	Pattern string `json:"pattern" yaml:"pattern"`
+
+	// Max number of requests of each matching type allowed to be run in parallel.
+	// If 0, every request of the matching types is limited
+	Limit uint32 `json:"limit" yaml:"limit"`
+
+	// Number of slots of the limit taken by each request. By default: 1
+	Weight uint32 `json:"weight,omitempty" yaml:"weight,omitempty"`
+
+	// Priority of the rule. If several rules match a type, the one with the highest priority applies.
+	// If tied, the first one in the list applies.
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// Configuration of the limit registry, as loaded from a file
+type LimitsConfig struct {
+	// List of limit rules
+	Rules []LimitRule `json:"rules" yaml:"rules"`
+
+	// Limit for the request types not matching any rule.
+	// By default: 0 (they are rejected with ErrUnknownRequestType)
+	DefaultLimit uint32 `json:"default_limit,omitempty" yaml:"default_limit,omitempty"`
+}
+
+// Registry of the limits of each request type
+// Safe to reload while the client is running
+type LimitRegistry struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Current configuration
+	config LimitsConfig
+}
+
+// Creates limit registry
+// Parameters:
+// - config - Limits configuration
+// Returns an error if any rule is not valid
+func NewLimitRegistry(config LimitsConfig) (*LimitRegistry, error) {
+	registry := &LimitRegistry{
+		mu: &sync.Mutex{},
+	}
+
+	err := registry.Update(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+// Creates limit registry, loading the configuration from a file
+// Parameters:
+// - path - Path to the file. JSON if the extension is .json, YAML otherwise
+func LoadLimitRegistry(path string) (*LimitRegistry, error) {
+	config, err := ReadLimitsConfig(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLimitRegistry(config)
+}
+
+// Reads a limits configuration file
+// Parameters:
+// - path - Path to the file. JSON if the extension is .json, YAML otherwise
+func ReadLimitsConfig(path string) (config LimitsConfig, err error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return LimitsConfig{}, err
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+
+	if err != nil {
+		return LimitsConfig{}, fmt.Errorf("invalid limits file %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// Replaces the configuration of the registry
+// The requests already started keep the limit they were started with
+// Parameters:
+// - config - Limits configuration
+// Returns an error if any rule is not valid. In that case, the current configuration is kept
+func (registry *LimitRegistry) Update(config LimitsConfig) error {
+	rules := make([]LimitRule, len(config.Rules))
+
+	for i, rule := range config.Rules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("invalid limit rule %d: empty pattern", i)
+		}
+
+		if rule.Weight == 0 {
+			rule.Weight = 1
+		}
+
+		if rule.Limit > 0 && rule.Weight > rule.Limit {
+			return fmt.Errorf("invalid limit rule %d (%s): the weight is greater than the limit", i, rule.Pattern)
+		}
+
+		rules[i] = rule
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.config = LimitsConfig{
+		Rules:        rules,
+		DefaultLimit: config.DefaultLimit,
+	}
+
+	return nil
+}
+
+// Reloads the configuration of the registry from a file
+// Parameters:
+// - path - Path to the file. JSON if the extension is .json, YAML otherwise
+// Returns an error if the file could not be loaded. In that case, the current configuration is kept
+func (registry *LimitRegistry) Reload(path string) error {
+	config, err := ReadLimitsConfig(path)
+
+	if err != nil {
+		return err
+	}
+
+	return registry.Update(config)
+}
+
+// Finds the rule for a request type
+// Parameters:
+// - requestType - Request type
+// Returns:
+// - rule - The rule for the type. If no rule matches, a rule with the default limit
+// - ok - False if no rule matches and there is no default limit
+func (registry *LimitRegistry) Lookup(requestType string) (rule LimitRule, ok bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	found := false
+
+	for _, r := range registry.config.Rules {
+		if (!found || r.Priority > rule.Priority) && matchLimitPattern(r.Pattern, requestType) {
+			rule = r
+			found = true
+		}
+	}
+
+	if found {
+		return rule, true
+	}
+
+	if registry.config.DefaultLimit == 0 {
+		return LimitRule{}, false
+	}
+
+	return LimitRule{
+		Pattern: "*",
+		Limit:   registry.config.DefaultLimit,
+		Weight:  1,
+	}, true
+}
+
+// Checks if a request type matches a limit pattern
+// The character '*' matches any sequence of characters
+func matchLimitPattern(pattern string, requestType string) bool {
+	parts := strings.Split(pattern, "*")
+
+	if len(parts) == 1 {
+		return pattern == requestType
+	}
+
+	if !strings.HasPrefix(requestType, parts[0]) {
+		return false
+	}
+
+	rest := requestType[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+
+		if i < 0 {
+			return false
+		}
+
+		rest = rest[i+len(part):]
+	}
+
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// Indicates the start of a request, using the limit of the type in the registry (ClientConfig.Limits)
+// Parameters:
+// - requestType - String to indicate the request type
+// Returns:
+// - result - Result of the request start. If not limited, keep result.Request to indicate the ending
+// - err - An error that prevented the request start indication from completing. ErrUnknownRequestType if the type has no limit
+func (cli *Client) StartRequestByName(requestType string) (result StartRequestResult, err error) {
+	return cli.StartRequestByNameContext(context.Background(), requestType)
+}
+
+// Indicates the start of a request, using the limit of the type in the registry (ClientConfig.Limits),
+// waiting for the server response until the context finishes
+// Parameters:
+// - ctx - Context to cancel the wait. The configured timeout also applies
+// - requestType - String to indicate the request type
+// Returns:
+// - result - Result of the request start. If not limited, keep result.Request to indicate the ending
+// - err - An error that prevented the request start indication from completing. ErrUnknownRequestType if the type has no limit
+func (cli *Client) StartRequestByNameContext(ctx context.Context, requestType string) (result StartRequestResult, err error) {
+	startTime := time.Now()
+
+	var rule LimitRule
+	found := false
+
+	if cli.config.Limits != nil {
+		rule, found = cli.config.Limits.Lookup(requestType)
+	}
+
+	if found {
+		result, err = cli.startRequest(ctx, requestType, rule.Limit, rule.Weight)
+	} else {
+		err = ErrUnknownRequestType
+	}
+
+	cli.reportStartRequest(requestType, result, err, time.Since(startTime))
+
+	return result, err
+}
@@ -0,0 +1,153 @@
+// Limit registry test
+
+package prc_client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchLimitPattern(t *testing.T) {
+	assert.True(t, matchLimitPattern("download", "download"))
+	assert.False(t, matchLimitPattern("download", "download-file"))
+
+	assert.True(t, matchLimitPattern("download-*", "download-file"))
+	assert.True(t, matchLimitPattern("download-*", "download-"))
+	assert.False(t, matchLimitPattern("download-*", "upload-file"))
+
+	assert.True(t, matchLimitPattern("*-user-*", "download-user-1"))
+	assert.False(t, matchLimitPattern("*-user-*", "download-user"))
+
+	assert.True(t, matchLimitPattern("a*b*b", "abb"))
+	assert.False(t, matchLimitPattern("a*b*b", "ab"))
+
+	assert.True(t, matchLimitPattern("*", "anything"))
+}
+
+func TestLimitRegistry(t *testing.T) {
+	registry, err := NewLimitRegistry(LimitsConfig{
+		Rules: []LimitRule{
+			{Pattern: "download-*", Limit: 10},
+			{Pattern: "download-large-*", Limit: 4, Weight: 2, Priority: 1},
+			{Pattern: "download-*-file", Limit: 5},
+		},
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The first matching rule applies, unless another one has a higher priority
+
+	rule, ok := registry.Lookup("download-small-file")
+
+	assert.True(t, ok)
+	assert.Equal(t, rule, LimitRule{Pattern: "download-*", Limit: 10, Weight: 1})
+
+	rule, ok = registry.Lookup("download-large-file")
+
+	assert.True(t, ok)
+	assert.Equal(t, rule, LimitRule{Pattern: "download-large-*", Limit: 4, Weight: 2, Priority: 1})
+
+	// Unknown types
+
+	_, ok = registry.Lookup("upload")
+
+	assert.False(t, ok)
+
+	err = registry.Update(LimitsConfig{DefaultLimit: 3})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rule, ok = registry.Lookup("upload")
+
+	assert.True(t, ok)
+	assert.Equal(t, rule.Limit, uint32(3))
+
+	// Invalid rules keep the current configuration
+
+	err = registry.Update(LimitsConfig{Rules: []LimitRule{{Pattern: "upload", Limit: 1, Weight: 2}}})
+
+	assert.Error(t, err)
+
+	rule, _ = registry.Lookup("upload")
+
+	assert.Equal(t, rule.Limit, uint32(3))
+}
+
+func TestLimitRegistryFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "limits.yaml")
+
+	err := os.WriteFile(yamlPath, []byte("default_limit: 2\nrules:\n  - pattern: report-*\n    limit: 6\n    weight: 3\n"), 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	registry, err := LoadLimitRegistry(yamlPath)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rule, ok := registry.Lookup("report-monthly")
+
+	assert.True(t, ok)
+	assert.Equal(t, rule, LimitRule{Pattern: "report-*", Limit: 6, Weight: 3})
+
+	rule, _ = registry.Lookup("other")
+
+	assert.Equal(t, rule.Limit, uint32(2))
+
+	// Reload from a JSON file
+
+	jsonPath := filepath.Join(dir, "limits.json")
+
+	err = os.WriteFile(jsonPath, []byte(`{"rules": [{"pattern": "report-*", "limit": 1}]}`), 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = registry.Reload(jsonPath)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rule, _ = registry.Lookup("report-monthly")
+
+	assert.Equal(t, rule, LimitRule{Pattern: "report-*", Limit: 1, Weight: 1})
+
+	_, ok = registry.Lookup("other")
+
+	assert.False(t, ok)
+
+	// Invalid files keep the current configuration
+
+	err = os.WriteFile(jsonPath, []byte(`{"rules": [`), 0600)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Error(t, registry.Reload(jsonPath))
+
+	rule, _ = registry.Lookup("report-monthly")
+
+	assert.Equal(t, rule.Limit, uint32(1))
+}
@@ -0,0 +1,62 @@
+// Local limiter
+
+package prc_client
+
+import "sync"
+
+// Local limiter, used to limit the requests while the controller is unreachable
+type LocalLimiter struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Map (Req type) -> Count
+	counts map[string]uint32
+}
+
+// Creates local limiter
+func NewLocalLimiter() *LocalLimiter {
+	return &LocalLimiter{
+		mu:     &sync.Mutex{},
+		counts: make(map[string]uint32),
+	}
+}
+
+// Tries to start a request
+// Parameters:
+// - requestType - Request type
+// - limit - Max number of requests for requestType
+// - weight - Number of slots taken by the request
+// Returns:
+// - started - True if success, false if the limit was reached
+// - count - Number of requests of the type, after the start attempt
+func (ll *LocalLimiter) TryStartRequest(requestType string, limit uint32, weight uint32) (started bool, count uint32) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	c := ll.counts[requestType]
+
+	if c >= limit || limit-c < weight {
+		return false, c
+	}
+
+	ll.counts[requestType] = c + weight
+
+	return true, c + weight
+}
+
+// Ends a request
+// Parameters:
+// - requestType - Request type
+// - weight - Number of slots taken by the request
+func (ll *LocalLimiter) EndRequest(requestType string, weight uint32) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	c := ll.counts[requestType]
+
+	if c <= weight {
+		delete(ll.counts, requestType)
+	} else {
+		ll.counts[requestType] = c - weight
+	}
+}
@@ -0,0 +1,110 @@
+// Observability hooks
+
+package prc_client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Outcome of a StartRequest call
+type StartRequestOutcome int
+
+const (
+	// The request was started
+	StartRequestAcquired StartRequestOutcome = iota
+
+	// The limit was reached (or the type was frozen)
+	StartRequestLimited
+
+	// The server did not respond in time
+	StartRequestTimeout
+
+	// Any other error
+	StartRequestError
+)
+
+// Gets the name of the outcome, used as a label by the metrics adapters
+func (outcome StartRequestOutcome) String() string {
+	switch outcome {
+	case StartRequestAcquired:
+		return "acquired"
+	case StartRequestLimited:
+		return "limited"
+	case StartRequestTimeout:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// Handler to collect metrics from the client.
+// The request types are normalized with ClientConfig.MetricsTypeNormalizer before calling the methods.
+// The methods are called from the goroutines of the client, so they should not block.
+type MetricsHandler interface {
+	// Called when a StartRequest call finishes
+	// Parameters:
+	// - requestType - Normalized request type
+	// - outcome - Outcome of the call
+	// - latency - Time spent waiting for the ACK
+	OnStartRequest(requestType string, outcome StartRequestOutcome, latency time.Duration)
+
+	// Called when a request started with StartRequest ends
+	// Parameters:
+	// - requestType - Normalized request type
+	OnRequestEnded(requestType string)
+
+	// Called when a connection is established again after being lost
+	// Parameters:
+	// - shardId - Identifier of the shard of the connection
+	OnReconnected(shardId string)
+}
+
+// Normalizes a request type for the metrics (for example, replacing identifiers with placeholders),
+// in order to limit the number of different labels
+type MetricsTypeNormalizer func(requestType string) string
+
+// Normalizes a request type for the metrics
+func (cli *Client) normalizeMetricsType(requestType string) string {
+	if cli.config.MetricsTypeNormalizer != nil {
+		return cli.config.MetricsTypeNormalizer(requestType)
+	}
+
+	return requestType
+}
+
+// Gets the outcome of a StartRequest call
+func getStartRequestOutcome(result StartRequestResult, err error) StartRequestOutcome {
+	if err != nil {
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrNotConnected) || errors.Is(err, context.DeadlineExceeded) {
+			return StartRequestTimeout
+		}
+
+		return StartRequestError
+	}
+
+	if result.Limited {
+		return StartRequestLimited
+	}
+
+	return StartRequestAcquired
+}
+
+// Reports a StartRequest call to the metrics handler
+func (cli *Client) reportStartRequest(requestType string, result StartRequestResult, err error, latency time.Duration) {
+	if cli.config.MetricsHandler == nil {
+		return
+	}
+
+	cli.config.MetricsHandler.OnStartRequest(cli.normalizeMetricsType(requestType), getStartRequestOutcome(result, err), latency)
+}
+
+// Reports the end of a request to the metrics handler
+func (cli *Client) reportRequestEnded(requestType string) {
+	if cli.config.MetricsHandler == nil {
+		return
+	}
+
+	cli.config.MetricsHandler.OnRequestEnded(cli.normalizeMetricsType(requestType))
+}
@@ -0,0 +1,29 @@
+module github.com/AgustinSRG/parallel-request-controller/client/prc_grpc
+
+go 1.22.0
+
+require (
+	github.com/AgustinSRG/parallel-request-controller/client v1.1.0
+	github.com/stretchr/testify v1.9.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.35.2
+)
+
+require (
+	github.com/AgustinSRG/go-simple-rpc-message v1.0.1 // indirect
+	github.com/AgustinSRG/parallel-request-controller/server v1.1.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.32.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+// Modules of the repository. Dependents ignore them and use the required releases
+replace (
+	github.com/AgustinSRG/parallel-request-controller/client => ../
+	github.com/AgustinSRG/parallel-request-controller/server => ../../server
+)
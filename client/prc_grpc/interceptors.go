@@ -0,0 +1,109 @@
+// gRPC server interceptors
+
+package prc_grpc
+
+import (
+	"context"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Function to get the request type and the limit for a gRPC call
+// Parameters:
+// - ctx - Context of the call
+// - fullMethod - Full method name. Example: /package.Service/Method
+// - md - Incoming metadata of the call
+// Returns the request type and the limit. Return an empty request type in order to not limit the call
+type KeyFunc func(ctx context.Context, fullMethod string, md metadata.MD) (requestType string, limit uint32)
+
+// Starts a request for a gRPC call
+// Returns the started request (nil if the call is not limited) or the status error to return
+func startRequest(ctx context.Context, cli *prc_client.Client, keyFunc KeyFunc, fullMethod string) (*prc_client.StartedRequest, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	requestType, limit := keyFunc(ctx, fullMethod, md)
+
+	if requestType == "" {
+		return nil, nil
+	}
+
+	res, err := cli.StartRequestContext(ctx, requestType, limit)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+
+		return nil, status.Error(codes.Unavailable, "parallel request controller unavailable: "+err.Error())
+	}
+
+	if res.Limited {
+		st := status.New(codes.ResourceExhausted, "parallel request limit reached")
+
+		if res.RetryAfter > 0 {
+			stWithDetails, err := st.WithDetails(&errdetails.RetryInfo{
+				RetryDelay: durationpb.New(res.RetryAfter),
+			})
+
+			if err == nil {
+				st = stWithDetails
+			}
+		}
+
+		return nil, st.Err()
+	}
+
+	return res.Request, nil
+}
+
+// Creates a unary server interceptor to limit the parallel calls
+// Limited calls fail with codes.ResourceExhausted, including RetryInfo if the server provided an estimation
+// Calls fail with codes.Unavailable if the controller cannot be reached
+// The request is ended when the handler returns, even if it panics
+// Parameters:
+// - cli - Client for the parallel request controller
+// - keyFunc - Function to get the request type and the limit for each call
+func UnaryServerInterceptor(cli *prc_client.Client, keyFunc KeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		startedRequest, err := startRequest(ctx, cli, keyFunc, info.FullMethod)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if startedRequest != nil {
+			defer startedRequest.End()
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// Creates a stream server interceptor to limit the parallel streams
+// Limited streams fail with codes.ResourceExhausted, including RetryInfo if the server provided an estimation
+// Streams fail with codes.Unavailable if the controller cannot be reached
+// The request is ended when the stream handler returns, even if it panics
+// Parameters:
+// - cli - Client for the parallel request controller
+// - keyFunc - Function to get the request type and the limit for each stream
+func StreamServerInterceptor(cli *prc_client.Client, keyFunc KeyFunc) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		startedRequest, err := startRequest(ss.Context(), cli, keyFunc, info.FullMethod)
+
+		if err != nil {
+			return err
+		}
+
+		if startedRequest != nil {
+			defer startedRequest.End()
+		}
+
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,187 @@
+// gRPC server interceptors test
+
+package prc_grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/AgustinSRG/parallel-request-controller/client/prctest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func waitForRequestCount(t *testing.T, cli *prc_client.Client, rType string, expected uint32) {
+	timeout := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(timeout) {
+		count, err := cli.GetRequestCount(rType)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if count == expected {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Timed out waiting for count %d", expected)
+}
+
+// Health server blocking the checks of the "block" service
+type testHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+
+	unblock chan struct{}
+}
+
+func (s *testHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.Service == "block" {
+		<-s.unblock
+	}
+
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *testHealthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+
+	if err != nil {
+		return err
+	}
+
+	<-stream.Context().Done()
+
+	return nil
+}
+
+func TestInterceptors(t *testing.T) {
+	prcServer := prctest.NewServer()
+	defer prcServer.Close()
+
+	cli := prc_client.NewClient(prcServer.ClientConfig())
+
+	cli.Connect()
+	defer cli.Close()
+
+	rType := "test-grpc-type"
+
+	keyFunc := func(ctx context.Context, fullMethod string, md metadata.MD) (string, uint32) {
+		if len(md.Get("skip-limit")) > 0 {
+			return "", 0
+		}
+
+		return rType, 1
+	}
+
+	// Start gRPC server
+
+	listener := bufconn.Listen(1024 * 1024)
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(cli, keyFunc)),
+		grpc.StreamInterceptor(StreamServerInterceptor(cli, keyFunc)),
+	)
+
+	healthServer := &testHealthServer{
+		unblock: make(chan struct{}),
+	}
+
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer conn.Close()
+
+	healthClient := grpc_health_v1.NewHealthClient(conn)
+
+	// Block the only slot
+
+	blockedDone := make(chan error)
+
+	go func() {
+		_, err := healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "block"})
+		blockedDone <- err
+	}()
+
+	waitForRequestCount(t, cli, rType, 1)
+
+	_, err = healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+
+	assert.Equal(t, status.Code(err), codes.ResourceExhausted)
+
+	// Not limited
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "skip-limit", "true")
+
+	_, err = healthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+
+	assert.NoError(t, err)
+
+	// Release the slot
+
+	close(healthServer.unblock)
+
+	assert.NoError(t, <-blockedDone)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Streams keep the slot until finished
+
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	defer cancelStream()
+
+	stream, err := healthClient.Watch(streamCtx, &grpc_health_v1.HealthCheckRequest{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = stream.Recv()
+
+	assert.NoError(t, err)
+
+	waitForRequestCount(t, cli, rType, 1)
+
+	stream2, err := healthClient.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = stream2.Recv()
+
+	assert.Equal(t, status.Code(err), codes.ResourceExhausted)
+
+	cancelStream()
+
+	waitForRequestCount(t, cli, rType, 0)
+}
@@ -0,0 +1,31 @@
+module github.com/AgustinSRG/parallel-request-controller/client/prc_otel
+
+go 1.22.0
+
+require (
+	github.com/AgustinSRG/parallel-request-controller/client v1.1.0
+	github.com/stretchr/testify v1.9.0
+	go.opentelemetry.io/otel v1.32.0
+	go.opentelemetry.io/otel/metric v1.32.0
+	go.opentelemetry.io/otel/sdk/metric v1.32.0
+)
+
+require (
+	github.com/AgustinSRG/go-simple-rpc-message v1.0.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/otel/sdk v1.32.0 // indirect
+	go.opentelemetry.io/otel/trace v1.32.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+// Modules of the repository. Dependents ignore them and use the required releases
+replace (
+	github.com/AgustinSRG/parallel-request-controller/client => ../
+	github.com/AgustinSRG/parallel-request-controller/server => ../../server
+)
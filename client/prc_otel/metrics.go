@@ -0,0 +1,105 @@
+// OpenTelemetry metrics
+
+package prc_otel
+
+import (
+	"context"
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OpenTelemetry metrics for the PRC client
+// Set it as the MetricsHandler of the client configuration
+type Metrics struct {
+	// Time spent waiting for the ACK
+	startRequestDuration metric.Float64Histogram
+
+	// Number of StartRequest calls
+	startRequests metric.Int64Counter
+
+	// Number of started requests not yet ended
+	inFlightRequests metric.Int64UpDownCounter
+
+	// Number of reconnections
+	reconnects metric.Int64Counter
+}
+
+// Creates the metrics
+// Parameters:
+// - meter - Meter to create the instruments. Example: otel.Meter("prc-client")
+func NewMetrics(meter metric.Meter) (*Metrics, error) {
+	startRequestDuration, err := meter.Float64Histogram(
+		"prc.client.start_request.duration",
+		metric.WithDescription("Time spent waiting for the parallel request controller to start a request."),
+		metric.WithUnit("s"),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	startRequests, err := meter.Int64Counter(
+		"prc.client.start_requests",
+		metric.WithDescription("Number of request starts, by outcome (acquired, limited, timeout, error)."),
+		metric.WithUnit("{request}"),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inFlightRequests, err := meter.Int64UpDownCounter(
+		"prc.client.in_flight_requests",
+		metric.WithDescription("Number of started requests not yet ended."),
+		metric.WithUnit("{request}"),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reconnects, err := meter.Int64Counter(
+		"prc.client.reconnects",
+		metric.WithDescription("Number of times a connection to the parallel request controller was established again."),
+		metric.WithUnit("{reconnect}"),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metrics{
+		startRequestDuration: startRequestDuration,
+		startRequests:        startRequests,
+		inFlightRequests:     inFlightRequests,
+		reconnects:           reconnects,
+	}, nil
+}
+
+// OnStartRequest implements prc_client.MetricsHandler
+func (m *Metrics) OnStartRequest(requestType string, outcome prc_client.StartRequestOutcome, latency time.Duration) {
+	attrs := metric.WithAttributes(
+		attribute.String("request_type", requestType),
+		attribute.String("outcome", outcome.String()),
+	)
+
+	m.startRequestDuration.Record(context.Background(), latency.Seconds(), attrs)
+	m.startRequests.Add(context.Background(), 1, attrs)
+
+	if outcome == prc_client.StartRequestAcquired {
+		m.inFlightRequests.Add(context.Background(), 1, metric.WithAttributes(attribute.String("request_type", requestType)))
+	}
+}
+
+// OnRequestEnded implements prc_client.MetricsHandler
+func (m *Metrics) OnRequestEnded(requestType string) {
+	m.inFlightRequests.Add(context.Background(), -1, metric.WithAttributes(attribute.String("request_type", requestType)))
+}
+
+// OnReconnected implements prc_client.MetricsHandler
+func (m *Metrics) OnReconnected(shardId string) {
+	m.reconnects.Add(context.Background(), 1, metric.WithAttributes(attribute.String("shard", shardId)))
+}
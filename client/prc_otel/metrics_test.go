@@ -0,0 +1,65 @@
+// OpenTelemetry metrics test
+
+package prc_otel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	m, err := NewMetrics(provider.Meter("test"))
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var _ prc_client.MetricsHandler = m
+
+	m.OnStartRequest("download", prc_client.StartRequestAcquired, 2*time.Millisecond)
+	m.OnStartRequest("download", prc_client.StartRequestAcquired, 3*time.Millisecond)
+	m.OnStartRequest("download", prc_client.StartRequestLimited, time.Millisecond)
+	m.OnRequestEnded("download")
+	m.OnReconnected("shard-1")
+
+	var rm metricdata.ResourceMetrics
+
+	err = reader.Collect(context.Background(), &rm)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	values := make(map[string]int64)
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, metric := range sm.Metrics {
+			switch data := metric.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, point := range data.DataPoints {
+					values[metric.Name] += point.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, point := range data.DataPoints {
+					values[metric.Name] += int64(point.Count)
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, values["prc.client.start_request.duration"], int64(3))
+	assert.Equal(t, values["prc.client.start_requests"], int64(3))
+	assert.Equal(t, values["prc.client.in_flight_requests"], int64(1))
+	assert.Equal(t, values["prc.client.reconnects"], int64(1))
+}
@@ -0,0 +1,32 @@
+module github.com/AgustinSRG/parallel-request-controller/client/prc_prometheus
+
+go 1.22.0
+
+require (
+	github.com/AgustinSRG/parallel-request-controller/client v1.1.0
+	github.com/prometheus/client_golang v1.20.5
+	github.com/stretchr/testify v1.9.0
+)
+
+require (
+	github.com/AgustinSRG/go-simple-rpc-message v1.0.1 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	google.golang.org/protobuf v1.35.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+// Modules of the repository. Dependents ignore them and use the required releases
+replace (
+	github.com/AgustinSRG/parallel-request-controller/client => ../
+	github.com/AgustinSRG/parallel-request-controller/server => ../../server
+)
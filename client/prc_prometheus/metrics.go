@@ -0,0 +1,95 @@
+// Prometheus metrics
+
+package prc_prometheus
+
+import (
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics for the PRC client
+// Set it as the MetricsHandler of the client configuration, and register it into a prometheus.Registerer
+type Metrics struct {
+	// Time spent waiting for the ACK
+	startRequestDuration *prometheus.HistogramVec
+
+	// Number of StartRequest calls
+	startRequests *prometheus.CounterVec
+
+	// Number of started requests not yet ended
+	inFlightRequests *prometheus.GaugeVec
+
+	// Number of reconnections
+	reconnects *prometheus.CounterVec
+}
+
+// Creates the metrics
+// Parameters:
+// - namespace - Namespace of the metrics. Example: myservice
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		startRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "prc_client",
+			Name:      "start_request_duration_seconds",
+			Help:      "Time spent waiting for the parallel request controller to start a request.",
+			Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"request_type", "outcome"}),
+		startRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "prc_client",
+			Name:      "start_requests_total",
+			Help:      "Number of request starts, by outcome (acquired, limited, timeout, error).",
+		}, []string{"request_type", "outcome"}),
+		inFlightRequests: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "prc_client",
+			Name:      "in_flight_requests",
+			Help:      "Number of started requests not yet ended.",
+		}, []string{"request_type"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "prc_client",
+			Name:      "reconnects_total",
+			Help:      "Number of times a connection to the parallel request controller was established again.",
+		}, []string{"shard"}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.startRequestDuration.Describe(ch)
+	m.startRequests.Describe(ch)
+	m.inFlightRequests.Describe(ch)
+	m.reconnects.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.startRequestDuration.Collect(ch)
+	m.startRequests.Collect(ch)
+	m.inFlightRequests.Collect(ch)
+	m.reconnects.Collect(ch)
+}
+
+// OnStartRequest implements prc_client.MetricsHandler
+func (m *Metrics) OnStartRequest(requestType string, outcome prc_client.StartRequestOutcome, latency time.Duration) {
+	m.startRequestDuration.WithLabelValues(requestType, outcome.String()).Observe(latency.Seconds())
+	m.startRequests.WithLabelValues(requestType, outcome.String()).Inc()
+
+	if outcome == prc_client.StartRequestAcquired {
+		m.inFlightRequests.WithLabelValues(requestType).Inc()
+	}
+}
+
+// OnRequestEnded implements prc_client.MetricsHandler
+func (m *Metrics) OnRequestEnded(requestType string) {
+	m.inFlightRequests.WithLabelValues(requestType).Dec()
+}
+
+// OnReconnected implements prc_client.MetricsHandler
+func (m *Metrics) OnReconnected(shardId string) {
+	m.reconnects.WithLabelValues(shardId).Inc()
+}
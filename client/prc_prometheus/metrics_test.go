@@ -0,0 +1,40 @@
+// Prometheus metrics test
+
+package prc_prometheus
+
+import (
+	"testing"
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics("test")
+
+	var _ prc_client.MetricsHandler = m
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+
+	m.OnStartRequest("download", prc_client.StartRequestAcquired, 2*time.Millisecond)
+	m.OnStartRequest("download", prc_client.StartRequestAcquired, 3*time.Millisecond)
+	m.OnStartRequest("download", prc_client.StartRequestLimited, time.Millisecond)
+	m.OnStartRequest("upload", prc_client.StartRequestTimeout, 10*time.Second)
+	m.OnRequestEnded("download")
+	m.OnReconnected("shard-1")
+
+	assert.Equal(t, testutil.ToFloat64(m.startRequests.WithLabelValues("download", "acquired")), float64(2))
+	assert.Equal(t, testutil.ToFloat64(m.startRequests.WithLabelValues("download", "limited")), float64(1))
+	assert.Equal(t, testutil.ToFloat64(m.startRequests.WithLabelValues("upload", "timeout")), float64(1))
+	assert.Equal(t, testutil.ToFloat64(m.inFlightRequests.WithLabelValues("download")), float64(1))
+	assert.Equal(t, testutil.ToFloat64(m.reconnects.WithLabelValues("shard-1")), float64(1))
+
+	count, err := testutil.GatherAndCount(registry, "test_prc_client_start_request_duration_seconds")
+
+	assert.NoError(t, err)
+	assert.Equal(t, count, 3)
+}
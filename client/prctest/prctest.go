@@ -0,0 +1,40 @@
+// Test server
+
+package prctest
+
+import (
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/AgustinSRG/parallel-request-controller/client/internal/testserver"
+)
+
+// Delay to retry the connection, for the clients of the test servers
+const TEST_RETRY_CONNECTION_DELAY = 100 * time.Millisecond
+
+// Parallel request controller server running in the process, for tests
+// It runs the server logic on an httptest.Server, behind a proxy used to inject faults:
+// - DropConnections - Drops the connections of every client
+// - SetAckDelay - Delays the START-REQUEST-ACK messages
+// - SetFault - Replies with an ERROR message to the messages of a method
+type Server struct {
+	*testserver.Server
+}
+
+// Starts a test server
+// Call Close when no longer needed
+func NewServer() *Server {
+	return &Server{
+		Server: testserver.NewServer(),
+	}
+}
+
+// Gets a client configuration ready to connect to the server
+// The configuration can be changed before creating the client
+func (server *Server) ClientConfig() *prc_client.ClientConfig {
+	return &prc_client.ClientConfig{
+		Url:                  server.Url(),
+		AuthToken:            server.AuthToken(),
+		RetryConnectionDelay: TEST_RETRY_CONNECTION_DELAY,
+	}
+}
@@ -0,0 +1,121 @@
+// Test server test
+
+package prctest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	prc_client "github.com/AgustinSRG/parallel-request-controller/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	cli := prc_client.NewClient(server.ClientConfig())
+
+	cli.Connect()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := cli.WaitUntilConnected(ctx)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.Equal(t, server.ConnectionCount(), 1)
+
+	rType := "test-type"
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, res.Limited)
+	assert.Equal(t, server.RequestCount(rType), uint32(1))
+
+	res.Request.End()
+
+	assert.True(t, server.WaitForRequestCount(rType, 0, 5*time.Second))
+}
+
+func TestServerFaults(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	config := server.ClientConfig()
+	config.Timeout = 200 * time.Millisecond
+
+	cli := prc_client.NewClient(config)
+
+	cli.Connect()
+	defer cli.Close()
+
+	rType := "test-type"
+
+	// Errors
+
+	server.SetFault("START-REQUEST", "TEST_ERROR", "Test error")
+
+	_, err := cli.StartRequest(rType, 1)
+
+	var serverErr *prc_client.ServerError
+
+	assert.True(t, errors.As(err, &serverErr))
+	assert.Equal(t, serverErr.Code, "TEST_ERROR")
+
+	server.ClearFaults()
+
+	// Dropped connections
+
+	res, err := cli.StartRequest(rType, 1)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	server.DropConnections()
+
+	select {
+	case <-res.Request.Lost():
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the request to be lost")
+	}
+
+	assert.True(t, server.WaitForRequestCount(rType, 0, 5*time.Second))
+
+	res.Request.End()
+
+	err = cli.WaitUntilConnected(context.Background())
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Delayed ACKs
+
+	server.SetAckDelay(time.Second)
+
+	_, err = cli.StartRequest(rType, 1)
+
+	assert.ErrorIs(t, err, prc_client.ErrTimeout)
+
+	server.SetAckDelay(0)
+
+	// The request is ended once the ACK is received, since the client stopped waiting
+
+	assert.True(t, server.WaitForRequestCount(rType, 0, 5*time.Second))
+}
@@ -0,0 +1,399 @@
+// Permits prefetching
+
+package prc_client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+// Default time without using the leased permits before returning them
+const DEFAULT_PREFETCH_IDLE_TIMEOUT = 5 * time.Second
+
+// Key of a pool of permits
+type PermitPoolKey struct {
+	// Connection used to lease the permits
+	connection *Connection
+
+	// Request type
+	requestType string
+}
+
+// Pool of permits leased from the server, for a request type
+type PermitPool struct {
+	// Permits leased and not in use
+	available uint32
+
+	// Permits in use
+	inUse uint32
+
+	// Limit used to lease the permits
+	limit uint32
+
+	// True if the server revoked the permits, since the type was frozen
+	// The permits in use are returned once their requests end
+	revoked bool
+
+	// True if the permits were released by the server (connection lost)
+	discarded bool
+
+	// Channel closed when the permits are released by the server
+	lost chan struct{}
+
+	// Last time a permit was taken or given back
+	lastUse time.Time
+
+	// Timer to return the permits after the idle timeout
+	idleTimer *time.Timer
+}
+
+// Manager of the permits leased from the server
+type PermitPrefetcher struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Pools of permits
+	pools map[PermitPoolKey]*PermitPool
+}
+
+// Creates permit prefetcher
+func NewPermitPrefetcher() *PermitPrefetcher {
+	return &PermitPrefetcher{
+		mu:    &sync.Mutex{},
+		pools: make(map[PermitPoolKey]*PermitPool),
+	}
+}
+
+// Checks if the permits of a request type must be prefetched
+func (cli *Client) mustPrefetch(requestType string) bool {
+	if cli.config.PrefetchPermits == 0 {
+		return false
+	}
+
+	return len(cli.config.PrefetchRequestTypes) == 0 || slices.Contains(cli.config.PrefetchRequestTypes, requestType)
+}
+
+// Gets the time without using the leased permits before returning them
+func (cli *Client) getPrefetchIdleTimeout() time.Duration {
+	if cli.config.PrefetchIdleTimeout > 0 {
+		return cli.config.PrefetchIdleTimeout
+	}
+
+	return DEFAULT_PREFETCH_IDLE_TIMEOUT
+}
+
+// Takes a permit from a pool and creates the started request
+// Call with the prefetcher mutex locked
+func (cli *Client) takePermit(key PermitPoolKey, pool *PermitPool) *StartedRequest {
+	pool.available--
+	pool.inUse++
+
+	cli.touchPermitPool(key, pool)
+
+	return &StartedRequest{
+		id:           0,
+		connection:   key.connection,
+		requestType:  key.requestType,
+		weight:       1,
+		localLimiter: nil,
+		permitPool:   pool,
+		endOnce:      &sync.Once{},
+		lost:         pool.lost,
+	}
+}
+
+// Updates the last use of a pool, scheduling the return of the idle permits
+// Call with the prefetcher mutex locked
+func (cli *Client) touchPermitPool(key PermitPoolKey, pool *PermitPool) {
+	pool.lastUse = time.Now()
+
+	if pool.idleTimer == nil {
+		pool.idleTimer = time.AfterFunc(cli.getPrefetchIdleTimeout(), func() {
+			cli.returnIdlePermits(key, pool)
+		})
+	} else {
+		pool.idleTimer.Reset(cli.getPrefetchIdleTimeout())
+	}
+}
+
+// Starts a request using a leased permit, leasing a new block of permits if none is available
+// Parameters:
+// - ctx - Context to cancel the wait for the lease
+// - shard - Shard owning the request type
+// - requestType - Request type
+// - limit - Limit for the request type, used when leasing
+func (cli *Client) startPrefetchedRequest(ctx context.Context, shard *Shard, requestType string, limit uint32) (result StartRequestResult, err error) {
+	pf := cli.prefetcher
+
+	// Use an available permit
+
+	pf.mu.Lock()
+
+	for _, conn := range shard.connections {
+		key := PermitPoolKey{connection: conn, requestType: requestType}
+		pool := pf.pools[key]
+
+		if pool == nil || pool.available == 0 || pool.revoked {
+			continue
+		}
+
+		if pool.limit > limit {
+			// Leased with a greater limit, so return the permits and lease again with the new one
+			permits := pool.available
+			pool.available = 0
+
+			pf.mu.Unlock()
+
+			conn.sendReturnPermits(requestType, permits)
+
+			pf.mu.Lock()
+
+			continue
+		}
+
+		request := cli.takePermit(key, pool)
+
+		pf.mu.Unlock()
+
+		return StartRequestResult{
+			Request: request,
+			Limited: false,
+			Limit:   limit,
+		}, nil
+	}
+
+	pf.mu.Unlock()
+
+	// Lease a new block
+
+	conn, _ := cli.getAvailableConnectionFromPool(shard)
+
+	msg := &simple_rpc_message.RPCMessage{
+		Method: "LEASE-PERMITS",
+		Params: map[string]string{
+			"Request-Type":  requestType,
+			"Request-Limit": fmt.Sprint(limit),
+			"Permits":       fmt.Sprint(cli.config.PrefetchPermits),
+		},
+		Body: "",
+	}
+
+	timeoutCtx, cancel := cli.withTimeout(ctx)
+	defer cancel()
+
+	reply, epoch, err := cli.sendQueryWithEpoch(timeoutCtx, conn, msg)
+
+	if err != nil {
+		return StartRequestResult{}, queryError(ctx, conn, err)
+	}
+
+	granted, err := strconv.ParseUint(reply.GetParam("Permits"), 10, 32)
+
+	if err != nil {
+		return StartRequestResult{}, ErrInvalidResponse
+	}
+
+	result = StartRequestResult{
+		Request: nil,
+		Limited: granted == 0,
+		Frozen:  strings.ToUpper(reply.GetParam("Request-Type-Frozen")) == "TRUE",
+	}
+
+	if count, err := strconv.ParseUint(reply.GetParam("Request-Count"), 10, 32); err == nil {
+		result.Count = uint32(count)
+	}
+
+	if limit, err := strconv.ParseUint(reply.GetParam("Request-Limit"), 10, 32); err == nil {
+		result.Limit = uint32(limit)
+	}
+
+	if retryAfter, err := strconv.ParseUint(reply.GetParam("Retry-After"), 10, 32); err == nil {
+		result.RetryAfter = time.Duration(retryAfter) * time.Millisecond
+	}
+
+	if granted == 0 {
+		return result, nil
+	}
+
+	// Add the permits to the pool of the connection
+
+	key := PermitPoolKey{connection: conn, requestType: requestType}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if conn.Epoch() != epoch {
+		// The connection was lost after the lease (even if connected again), so the permits were released
+		// If lost after this check, the permits are discarded with the pool
+		return StartRequestResult{}, ErrNotConnected
+	}
+
+	pool := pf.pools[key]
+
+	if pool == nil {
+		pool = &PermitPool{
+			available: 0,
+			inUse:     0,
+			discarded: false,
+			lost:      make(chan struct{}),
+		}
+		pf.pools[key] = pool
+	}
+
+	// Permits leased after the freeze, so the pool can be used again
+
+	pool.available += uint32(granted)
+	pool.limit = limit
+	pool.revoked = false
+
+	result.Request = cli.takePermit(key, pool)
+
+	return result, nil
+}
+
+// Gives back a permit to its pool, once the request ends
+func (cli *Client) releasePermit(request *StartedRequest) {
+	pf := cli.prefetcher
+
+	pf.mu.Lock()
+
+	pool := request.permitPool
+
+	if pool.discarded {
+		pf.mu.Unlock()
+		return
+	}
+
+	key := PermitPoolKey{connection: request.connection, requestType: request.requestType}
+
+	if pool.revoked {
+		// Return the permit, since the type was frozen
+
+		pool.inUse--
+
+		if pool.inUse == 0 && pool.available == 0 {
+			cli.discardPermitPool(key, pool)
+		}
+
+		pf.mu.Unlock()
+
+		request.connection.sendReturnPermits(request.requestType, 1)
+
+		return
+	}
+
+	pool.inUse--
+	pool.available++
+
+	cli.touchPermitPool(key, pool)
+
+	pf.mu.Unlock()
+}
+
+// Returns the available permits of a pool to the server, after the server revoked them since the type was frozen
+// The permits in use are returned once their requests end
+func (cli *Client) onPermitsRevoked(conn *Connection, requestType string) {
+	pf := cli.prefetcher
+
+	pf.mu.Lock()
+
+	key := PermitPoolKey{connection: conn, requestType: requestType}
+	pool := pf.pools[key]
+
+	if pool == nil {
+		pf.mu.Unlock()
+		return
+	}
+
+	permits := pool.available
+
+	pool.available = 0
+	pool.revoked = true
+
+	if pool.inUse == 0 {
+		cli.discardPermitPool(key, pool)
+	}
+
+	pf.mu.Unlock()
+
+	if permits > 0 {
+		conn.sendReturnPermits(requestType, permits)
+	}
+}
+
+// Removes a pool with no permits left
+// Call with the prefetcher mutex locked
+func (cli *Client) discardPermitPool(key PermitPoolKey, pool *PermitPool) {
+	pool.discarded = true
+
+	if pool.idleTimer != nil {
+		pool.idleTimer.Stop()
+	}
+
+	if cli.prefetcher.pools[key] == pool {
+		delete(cli.prefetcher.pools, key)
+	}
+}
+
+// Returns the permits of a pool to the server, if not used during the idle timeout
+func (cli *Client) returnIdlePermits(key PermitPoolKey, pool *PermitPool) {
+	pf := cli.prefetcher
+
+	pf.mu.Lock()
+
+	if pool.discarded || pool.available == 0 {
+		pf.mu.Unlock()
+		return
+	}
+
+	if idle := time.Since(pool.lastUse); idle < cli.getPrefetchIdleTimeout() {
+		// Used after the timer fired
+		pool.idleTimer.Reset(cli.getPrefetchIdleTimeout() - idle)
+		pf.mu.Unlock()
+		return
+	}
+
+	permits := pool.available
+	pool.available = 0
+
+	if pool.inUse == 0 {
+		pool.discarded = true
+		delete(pf.pools, key)
+	}
+
+	pf.mu.Unlock()
+
+	key.connection.sendReturnPermits(key.requestType, permits)
+}
+
+// Discards the permits leased by a connection, since the server releases them when the connection is lost
+// The requests using them are marked as lost
+func (cli *Client) onPermitsLost(conn *Connection) {
+	pf := cli.prefetcher
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	for key, pool := range pf.pools {
+		if key.connection != conn {
+			continue
+		}
+
+		pool.discarded = true
+
+		if pool.idleTimer != nil {
+			pool.idleTimer.Stop()
+		}
+
+		close(pool.lost)
+
+		delete(pf.pools, key)
+	}
+}
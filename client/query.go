@@ -0,0 +1,170 @@
+// Queries (messages with a reply matched by Query-ID)
+
+package prc_client
+
+import (
+	"context"
+	"fmt"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+)
+
+// Reply to a query
+type QueryReply struct {
+	// Reply message
+	message *simple_rpc_message.RPCMessage
+
+	// Epoch of the connection when the reply was received
+	epoch uint64
+}
+
+// Listener for a query reply
+type QueryReplyListener struct {
+	// Channel to receive the reply
+	channel chan *QueryReply
+}
+
+// Gets new unique query ID for this client
+func (cli *Client) getNewQueryId() uint64 {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	id := cli.nextQueryId
+
+	cli.nextQueryId++
+
+	return id
+}
+
+// Removes a query reply listener
+func (cli *Client) removeQueryReplyListener(id uint64) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	delete(cli.expectingQueryReply, id)
+}
+
+// Receives a query reply from a connection
+// Returns true if there was a call waiting for it
+func (cli *Client) receiveQueryReply(id uint64, reply *QueryReply) bool {
+	var listener *QueryReplyListener = nil
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	listener = cli.expectingQueryReply[id]
+
+	if listener == nil {
+		return false
+	}
+
+	// Delivered while locked, so the reply is either received by the listener
+	// or found by abandonQuery after removing it
+
+	select {
+	case listener.channel <- reply:
+	default:
+	}
+
+	return true
+}
+
+// Stops waiting for a query reply, since the context finished or the client was closed
+// If the reply was already delivered, the permits leased by it are returned to the server
+// Parameters:
+// - conn - Connection used to send the query
+// - id - Query ID
+// - listener - Listener of the reply
+func (cli *Client) abandonQuery(conn *Connection, id uint64, listener *QueryReplyListener) {
+	cli.removeQueryReplyListener(id)
+
+	select {
+	case reply := <-listener.channel:
+		conn.returnLeasedPermits(reply.message)
+	default:
+	}
+}
+
+// Sends a query and waits for the reply
+// The query is sent again if the connection is lost before receiving the reply
+// Parameters:
+// - ctx - Context to cancel the wait
+// - conn - Connection to send the query
+// - msg - Message to send. The Query-ID parameter is set by this method
+// Returns:
+// - reply - The reply message
+// - err - The context error if the context finished before receiving the reply. ErrUnavailable if the connection is not established and the policy requires to fail.
+// ErrClosed if the client was closed. *ServerError if the server responded with an error
+func (cli *Client) sendQuery(ctx context.Context, conn *Connection, msg *simple_rpc_message.RPCMessage) (reply *simple_rpc_message.RPCMessage, err error) {
+	reply, _, err = cli.sendQueryWithEpoch(ctx, conn, msg)
+	return reply, err
+}
+
+// Sends a query and waits for the reply, getting the epoch of the connection when the reply was received
+// The epoch tells if the connection was lost after the reply, since the query may be sent again after a reconnection
+// Parameters:
+// - ctx - Context to cancel the wait
+// - conn - Connection to send the query
+// - msg - Message to send. The Query-ID parameter is set by this method
+// Returns:
+// - reply - The reply message
+// - epoch - Epoch of the connection when the reply was received
+// - err - Same errors as sendQuery
+func (cli *Client) sendQueryWithEpoch(ctx context.Context, conn *Connection, msg *simple_rpc_message.RPCMessage) (reply *simple_rpc_message.RPCMessage, epoch uint64, err error) {
+	closedChan, closed := cli.getClosedChan()
+
+	if closed {
+		return nil, 0, ErrClosed
+	}
+
+	if cli.mustFailWhenUnavailable() && !conn.IsConnected() {
+		return nil, 0, ErrUnavailable
+	}
+
+	id := cli.getNewQueryId()
+
+	if msg.Params == nil {
+		msg.Params = make(map[string]string)
+	}
+
+	msg.Params["Query-ID"] = fmt.Sprint(id)
+
+	// Setup listener for the reply
+
+	listener := &QueryReplyListener{
+		channel: make(chan *QueryReply, 1),
+	}
+
+	cli.mu.Lock()
+
+	cli.expectingQueryReply[id] = listener
+
+	cli.mu.Unlock()
+
+	defer cli.removeQueryReplyListener(id)
+
+	// Send the query
+
+	conn.SendQuery(id, msg)
+	defer conn.QueryDone(id)
+
+	// Wait
+
+	select {
+	case reply := <-listener.channel:
+		if reply.message.Method == "ERROR" {
+			return nil, 0, &ServerError{
+				Code:    reply.message.GetParam("Error-Code"),
+				Message: reply.message.GetParam("Error-Message"),
+			}
+		}
+
+		return reply.message, reply.epoch, nil
+	case <-ctx.Done():
+		cli.abandonQuery(conn, id, listener)
+		return nil, 0, ctx.Err()
+	case <-closedChan:
+		cli.abandonQuery(conn, id, listener)
+		return nil, 0, ErrClosed
+	}
+}
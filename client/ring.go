@@ -0,0 +1,92 @@
+// Consistent hashing
+
+package prc_client
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Number of points of each shard in the hash ring
+const HASH_RING_VIRTUAL_NODES = 160
+
+// Point of the hash ring
+type HashRingPoint struct {
+	// Hash of the point
+	hash uint64
+
+	// Index of the shard owning the point
+	shard int
+}
+
+// Consistent hash ring, to assign request types to shards
+// Adding or removing a shard only moves the types owned by it
+type HashRing struct {
+	// Points, sorted by hash
+	points []HashRingPoint
+}
+
+// Hashes a string for the ring
+func hashRingKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	v := h.Sum64()
+
+	// Mix the bits, since FNV is weak for similar keys
+
+	v ^= v >> 33
+	v *= 0xff51afd7ed558ccd
+	v ^= v >> 33
+	v *= 0xc4ceb9fe1a85ec53
+	v ^= v >> 33
+
+	return v
+}
+
+// Creates hash ring
+// Parameters:
+// - shardIds - Unique identifiers of the shards. The shard indexes returned by the ring are the indexes of this list
+func NewHashRing(shardIds []string) *HashRing {
+	points := make([]HashRingPoint, 0, len(shardIds)*HASH_RING_VIRTUAL_NODES)
+
+	for i, id := range shardIds {
+		for v := 0; v < HASH_RING_VIRTUAL_NODES; v++ {
+			points = append(points, HashRingPoint{
+				hash:  hashRingKey(id + "#" + strconv.Itoa(v)),
+				shard: i,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+
+		return shardIds[points[i].shard] < shardIds[points[j].shard]
+	})
+
+	return &HashRing{
+		points: points,
+	}
+}
+
+// Gets the index of the shard owning a key
+func (ring *HashRing) Get(key string) int {
+	if len(ring.points) == 0 {
+		return 0
+	}
+
+	h := hashRingKey(key)
+
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+
+	if i >= len(ring.points) {
+		i = 0
+	}
+
+	return ring.points[i].shard
+}
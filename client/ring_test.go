@@ -0,0 +1,57 @@
+// Consistent hashing test
+
+package prc_client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	keysCount := 10000
+
+	ring := NewHashRing([]string{"a", "b", "c", "d"})
+
+	// Every shard owns a similar fraction of the keys
+
+	owners := make([]int, keysCount)
+	perShard := make(map[int]int)
+
+	for i := 0; i < keysCount; i++ {
+		owners[i] = ring.Get(fmt.Sprint("request-type-", i))
+		perShard[owners[i]]++
+	}
+
+	assert.Equal(t, len(perShard), 4)
+
+	for shard, count := range perShard {
+		assert.Greater(t, count, keysCount/8, fmt.Sprint("Shard ", shard, " owns too few keys"))
+	}
+
+	// The order of the shards does not change the owners
+
+	reversed := NewHashRing([]string{"d", "c", "b", "a"})
+
+	for i := 0; i < keysCount; i++ {
+		assert.Equal(t, 3-reversed.Get(fmt.Sprint("request-type-", i)), owners[i])
+	}
+
+	// Adding a shard only moves keys to the new shard
+
+	extended := NewHashRing([]string{"a", "b", "c", "d", "e"})
+
+	moved := 0
+
+	for i := 0; i < keysCount; i++ {
+		owner := extended.Get(fmt.Sprint("request-type-", i))
+
+		if owner != owners[i] {
+			assert.Equal(t, owner, 4)
+			moved++
+		}
+	}
+
+	assert.Less(t, moved, keysCount*3/10)
+}
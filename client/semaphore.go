@@ -0,0 +1,226 @@
+// Distributed semaphore
+
+package prc_client
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Min delay to retry the acquisition of a semaphore when the limit is reached
+const SEMAPHORE_MIN_BACKOFF = 10 * time.Millisecond
+
+// Max delay to retry the acquisition of a semaphore when the limit is reached
+const SEMAPHORE_MAX_BACKOFF = time.Second
+
+// Weighted semaphore, with the same methods as golang.org/x/sync/semaphore.Weighted
+type Semaphore interface {
+	// Acquires n slots, waiting until available or the context finishes
+	Acquire(ctx context.Context, n int64) error
+
+	// Acquires n slots without waiting. Returns false if not available
+	TryAcquire(n int64) bool
+
+	// Releases n slots
+	Release(n int64)
+}
+
+// Semaphore shared by every client, bound to a request type and a limit
+// The slots acquired at once are taken by a single weighted request of the type
+type DistributedSemaphore struct {
+	// Client
+	cli *Client
+
+	// Request type
+	requestType string
+
+	// Max number of slots
+	limit uint32
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Requests started for the acquired slots
+	held []*StartedRequest
+
+	// Number of slots held
+	heldSlots int64
+}
+
+// Creates a distributed semaphore
+// Parameters:
+// - requestType - Request type used for the slots
+// - limit - Max number of slots, shared by every client
+func (cli *Client) NewDistributedSemaphore(requestType string, limit uint32) *DistributedSemaphore {
+	return &DistributedSemaphore{
+		cli:         cli,
+		requestType: requestType,
+		limit:       limit,
+		mu:          &sync.Mutex{},
+		held:        make([]*StartedRequest, 0),
+		heldSlots:   0,
+	}
+}
+
+// Tries to acquire n slots once
+// The slots are taken by a single request with weight n, so either all of them or none are acquired
+// Returns:
+// - acquired - True if the slots were acquired
+// - retryAfter - Estimated time until the slots are available, if not acquired. 0 if unknown
+// - err - Error that prevented the acquisition
+func (sem *DistributedSemaphore) tryAcquire(ctx context.Context, n int64) (acquired bool, retryAfter time.Duration, err error) {
+	startTime := time.Now()
+
+	res, err := sem.cli.startRequest(ctx, sem.requestType, sem.limit, uint32(n))
+
+	sem.cli.reportStartRequest(sem.requestType, res, err, time.Since(startTime))
+
+	if err != nil || res.Limited {
+		return false, res.RetryAfter, err
+	}
+
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	sem.held = append(sem.held, res.Request)
+	sem.heldSlots += n
+
+	return true, 0, nil
+}
+
+// Acquires n slots, waiting until available or the context finishes
+// While the limit is reached, the acquisition is retried with exponential backoff,
+// waiting at least the time estimated by the server
+// Parameters:
+// - ctx - Context to cancel the wait
+// - n - Number of slots
+// Returns the context error if it finished, or any error starting the request
+func (sem *DistributedSemaphore) Acquire(ctx context.Context, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+
+	if n > int64(sem.limit) {
+		// Never available
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	backoff := SEMAPHORE_MIN_BACKOFF
+
+	for {
+		acquired, retryAfter, err := sem.tryAcquire(ctx, n)
+
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			return nil
+		}
+
+		err = waitBackoff(ctx, backoff, retryAfter, SEMAPHORE_MAX_BACKOFF)
+
+		if err != nil {
+			return err
+		}
+
+		backoff = min(backoff*2, SEMAPHORE_MAX_BACKOFF)
+	}
+}
+
+// Waits before retrying to start a limited request
+// Parameters:
+// - ctx - Context to cancel the wait
+// - backoff - Current backoff delay
+// - retryAfter - Time estimated by the server. 0 if unknown
+// - maxBackoff - Max delay to wait
+// Returns the context error if it finished during the wait
+func waitBackoff(ctx context.Context, backoff time.Duration, retryAfter time.Duration, maxBackoff time.Duration) error {
+	return sleepContext(ctx, addJitter(min(max(backoff, retryAfter), maxBackoff)))
+}
+
+// Waits for a delay, or until the context finishes
+// Returns the context error if it finished during the wait
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Acquires n slots without waiting for them to be available
+// It still waits for the server response, up to the configured timeout
+// Parameters:
+// - n - Number of slots
+// Returns true if the slots were acquired
+func (sem *DistributedSemaphore) TryAcquire(n int64) bool {
+	if n <= 0 {
+		return true
+	}
+
+	if n > int64(sem.limit) {
+		return false
+	}
+
+	acquired, _, _ := sem.tryAcquire(context.Background(), n)
+
+	return acquired
+}
+
+// Releases n slots
+// The requests of the most recent acquisitions are ended first.
+// If only some of the slots of a request are released, the request keeps the rest of them.
+// Panics if releasing more slots than held
+// Parameters:
+// - n - Number of slots
+func (sem *DistributedSemaphore) Release(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	sem.mu.Lock()
+
+	if n > sem.heldSlots {
+		sem.mu.Unlock()
+		panic("prc_client: semaphore released more than held")
+	}
+
+	sem.heldSlots -= n
+
+	released := make([]*StartedRequest, 0)
+
+	for n > 0 {
+		last := sem.held[len(sem.held)-1]
+
+		if n < int64(last.weight) {
+			// Partial release. Done while locked, since the request is still held
+			last.releaseSlots(uint32(n))
+			break
+		}
+
+		n -= int64(last.weight)
+
+		released = append(released, last)
+		sem.held = sem.held[:len(sem.held)-1]
+	}
+
+	sem.mu.Unlock()
+
+	for _, r := range released {
+		r.End()
+	}
+}
+
+// Adds jitter to a delay, so the clients do not retry at the same time
+// Returns a random delay between the half of the delay and the delay
+func addJitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
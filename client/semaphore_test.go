@@ -0,0 +1,84 @@
+// Distributed semaphore test
+
+package prc_client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistributedSemaphore(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-semaphore-type"
+
+	var sem Semaphore = cli.NewDistributedSemaphore(rType, 2)
+
+	err := sem.Acquire(context.Background(), 2)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	assert.False(t, sem.TryAcquire(1))
+
+	waitForRequestCount(t, cli, rType, 2)
+
+	// Wait until the context finishes
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, sem.Acquire(ctx, 1), context.DeadlineExceeded)
+
+	// More than the limit
+
+	assert.False(t, sem.TryAcquire(3))
+
+	// Wait until released
+
+	acquired := make(chan error, 1)
+
+	go func() {
+		acquired <- sem.Acquire(context.Background(), 1)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Releases one of the slots acquired at once
+
+	sem.Release(1)
+
+	select {
+	case err := <-acquired:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the semaphore")
+	}
+
+	waitForRequestCount(t, cli, rType, 2)
+
+	sem.Release(2)
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	assert.Panics(t, func() {
+		sem.Release(1)
+	})
+
+	cli.Close()
+}
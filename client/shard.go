@@ -0,0 +1,45 @@
+// Sharding of request types
+
+package prc_client
+
+// Shard of the request types, owned by a single controller
+type Shard struct {
+	// Shard identifier, used to place it in the hash ring
+	id string
+
+	// Connections to the controller
+	connections []*Connection
+
+	// Index to balance the use of the connections
+	connectionBalancer int
+
+	// Selector of the endpoint to connect to
+	endpointSelector *EndpointSelector
+}
+
+// Creates shard, with its pool of connections
+func NewShard(cli *Client, config *ClientConfig, shardConfig ShardConfig, connectionsCount int) *Shard {
+	shard := &Shard{
+		id:                 shardConfig.GetId(),
+		connections:        make([]*Connection, connectionsCount),
+		connectionBalancer: 0,
+		endpointSelector:   NewEndpointSelector(shardConfig.Urls, config.EndpointStrategy, config.GetEndpointBackoff()),
+	}
+
+	for i := 0; i < connectionsCount; i++ {
+		shard.connections[i] = NewConnection(cli, config)
+		shard.connections[i].shard = shard
+		shard.connections[i].index = i
+	}
+
+	return shard
+}
+
+// Gets the shard owning a request type
+func (cli *Client) getShard(requestType string) *Shard {
+	if len(cli.shards) == 1 {
+		return cli.shards[0]
+	}
+
+	return cli.shards[cli.ring.Get(requestType)]
+}
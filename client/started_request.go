@@ -2,6 +2,8 @@
 
 package prc_client
 
+import "sync"
+
 // Started request. Keep it to indicate the ending.
 type StartedRequest struct {
 	// Request ID
@@ -9,9 +11,85 @@ type StartedRequest struct {
 
 	// Reference to the connection where the start message wa sent
 	connection *Connection
+
+	// Request type
+	requestType string
+
+	// Number of slots taken by the request
+	weight uint32
+
+	// Local limiter, if the request was started locally while the controller was unreachable
+	localLimiter *LocalLimiter
+
+	// Pool of the leased permit used by the request, if started with a prefetched permit
+	permitPool *PermitPool
+
+	// Ensures the request is ended only once
+	endOnce *sync.Once
+
+	// Channel closed when the slot is released by the server without ending the request
+	lost <-chan struct{}
 }
 
 // Indicates the ending of the request
+// Calling it more than once has no effect
 func (request *StartedRequest) End() {
-	request.connection.EndRequest(request.id)
+	request.end("")
+}
+
+// Indicates the ending of the request, reporting whether it succeeded, so the server can track the failure rate of the type
+// Calling it more than once (or after End) has no effect
+// Parameters:
+// - success - True if the request succeeded
+func (request *StartedRequest) EndWithOutcome(success bool) {
+	if success {
+		request.end("TRUE")
+	} else {
+		request.end("FALSE")
+	}
+}
+
+// Ends the request, once
+// Parameters:
+// - success - Value of the Request-Success parameter. Empty to not report the outcome
+func (request *StartedRequest) end(success string) {
+	request.endOnce.Do(func() {
+		if request.permitPool != nil {
+			// The permit is kept for other requests, so the outcome is not reported
+			request.connection.cli.releasePermit(request)
+		} else {
+			request.connection.EndRequestWithOutcome(request.id, success)
+		}
+
+		if request.localLimiter != nil {
+			request.localLimiter.EndRequest(request.requestType, request.weight)
+		}
+
+		request.connection.cli.reportRequestEnded(request.requestType)
+	})
+}
+
+// Releases some slots of the request, keeping it running with the rest
+// Not safe to call concurrently with End or itself
+// Parameters:
+// - weight - Number of slots to release. Must be less than the slots held by the request
+func (request *StartedRequest) releaseSlots(weight uint32) {
+	if weight == 0 || weight >= request.weight {
+		return
+	}
+
+	request.weight -= weight
+
+	request.connection.ReleaseRequestSlots(request.id, weight)
+
+	if request.localLimiter != nil {
+		request.localLimiter.EndRequest(request.requestType, weight)
+	}
+}
+
+// Gets a channel closed when the server releases the slot of the request for any reason other than End.
+// For example, when the connection to the server is lost.
+// Once closed, the request is no longer counted by the server.
+func (request *StartedRequest) Lost() <-chan struct{} {
+	return request.lost
 }
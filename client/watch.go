@@ -0,0 +1,169 @@
+// Request count watches
+
+package prc_client
+
+import "sync"
+
+// Watcher of request count changes
+type RequestCountWatcher struct {
+	// Channel to receive the updates
+	channel chan uint32
+
+	// True if the channel is closed (protected by the client mutex)
+	closed bool
+}
+
+// Watched request type
+type WatchedRequestType struct {
+	// Connection used to subscribe to the changes
+	connection *Connection
+
+	// List of watchers
+	watchers []*RequestCountWatcher
+
+	// True if a count was received for the type
+	hasCount bool
+
+	// Last received count
+	lastCount uint32
+}
+
+// Pushes a count to the watcher channel, replacing any count not yet received
+func (watcher *RequestCountWatcher) push(count uint32) {
+	for {
+		select {
+		case watcher.channel <- count:
+			return
+		default:
+		}
+
+		// Drop the outdated count
+
+		select {
+		case <-watcher.channel:
+		default:
+		}
+	}
+}
+
+// Closes the watcher channel
+// Must be called with the client lock acquired
+func (watcher *RequestCountWatcher) close() {
+	if watcher.closed {
+		return
+	}
+
+	watcher.closed = true
+	close(watcher.channel)
+}
+
+// Watches the parallel request count of a type
+// The server pushes the current count on subscription and after every change
+// If the connection is lost, the subscription is renewed after reconnecting
+// Parameters:
+// - requestType - String to indicate the request type
+// Returns:
+// - updates - Channel to receive the counts. Only the latest count is kept if the receiver is slow. Closed when cancelled or when the client is closed.
+// - cancel - Function to cancel the watch
+func (cli *Client) Watch(requestType string) (updates <-chan uint32, cancel func()) {
+	watcher := &RequestCountWatcher{
+		channel: make(chan uint32, 1),
+	}
+
+	if requestType == "" {
+		close(watcher.channel)
+		return watcher.channel, func() {}
+	}
+
+	conn := cli.getConnectionFromPool(cli.getShard(requestType))
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if cli.closed {
+		watcher.close()
+		return watcher.channel, func() {}
+	}
+
+	wrt := cli.watchedRequestTypes[requestType]
+
+	if wrt == nil {
+		wrt = &WatchedRequestType{
+			connection: conn,
+			watchers:   make([]*RequestCountWatcher, 0, 1),
+			hasCount:   false,
+			lastCount:  0,
+		}
+		cli.watchedRequestTypes[requestType] = wrt
+
+		conn.WatchRequestType(requestType)
+	} else if wrt.hasCount {
+		watcher.push(wrt.lastCount)
+	}
+
+	wrt.watchers = append(wrt.watchers, watcher)
+
+	once := &sync.Once{}
+
+	return watcher.channel, func() {
+		once.Do(func() {
+			cli.removeWatcher(requestType, watcher)
+		})
+	}
+}
+
+// Removes a watcher, cancelling the subscription if it was the last one for the type
+func (cli *Client) removeWatcher(requestType string, watcher *RequestCountWatcher) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	wrt := cli.watchedRequestTypes[requestType]
+
+	if wrt != nil {
+		newWatchers := make([]*RequestCountWatcher, 0, len(wrt.watchers))
+
+		for _, w := range wrt.watchers {
+			if w != watcher {
+				newWatchers = append(newWatchers, w)
+			}
+		}
+
+		wrt.watchers = newWatchers
+
+		if len(newWatchers) == 0 {
+			delete(cli.watchedRequestTypes, requestType)
+			wrt.connection.UnwatchRequestType(requestType)
+		}
+	}
+
+	watcher.close()
+}
+
+// Closes the channels of every watcher
+// Must be called with the lock acquired
+func (cli *Client) closeWatchers() {
+	for requestType, wrt := range cli.watchedRequestTypes {
+		for _, watcher := range wrt.watchers {
+			watcher.close()
+		}
+
+		delete(cli.watchedRequestTypes, requestType)
+	}
+}
+
+// Notifies the watchers of a request type
+// Must be called with the lock acquired
+func (cli *Client) notifyWatchers(requestType string, count uint32) {
+	wrt := cli.watchedRequestTypes[requestType]
+
+	if wrt == nil {
+		return
+	}
+
+	wrt.hasCount = true
+	wrt.lastCount = count
+
+	for _, watcher := range wrt.watchers {
+		watcher.push(count)
+	}
+}
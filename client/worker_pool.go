@@ -0,0 +1,273 @@
+// Worker pool
+
+package prc_client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Default number of workers of a worker pool
+const DEFAULT_WORKER_POOL_WORKERS = 1
+
+// Min delay to retry a job, when limited
+const WORKER_POOL_MIN_BACKOFF = 100 * time.Millisecond
+
+// Max delay to retry a job, when limited
+const WORKER_POOL_MAX_BACKOFF = 30 * time.Second
+
+// Max number of request types with a backoff kept by a worker pool
+// The types beyond it are retried with the min backoff
+const WORKER_POOL_MAX_BACKOFF_TYPES = 1024
+
+// Job run by a worker pool
+type Job interface {
+	// Runs the job
+	// The context is cancelled when the pool stops, or if the slot of the request is lost (with ErrLost as the cause)
+	Run(ctx context.Context) error
+}
+
+// Source of jobs for a worker pool (for example, a queue)
+type JobSource interface {
+	// Gets the next job, waiting until available or the context finishes
+	// Returns the context error if it finished
+	Next(ctx context.Context) (Job, error)
+
+	// Puts back a job that could not be started, so it is returned again by Next after a delay
+	// Parameters:
+	// - job - The job
+	// - delay - Min time to wait before returning the job again
+	Requeue(job Job, delay time.Duration) error
+}
+
+// Function to get the request type and the limit for a job
+// Return an empty request type in order to not limit the job
+type JobTypeFunc func(job Job) (requestType string, limit uint32)
+
+// Handler for the errors of a worker pool
+type WorkerPoolErrorHandler interface {
+	// Called when a job fails, or when a job cannot be started or requeued
+	// The job is nil if the error was returned by JobSource.Next
+	OnJobError(job Job, err error)
+}
+
+// Configuration of a worker pool
+type WorkerPoolConfig struct {
+	// Client for the parallel request controller
+	Client *Client
+
+	// Source of jobs
+	Source JobSource
+
+	// Function to get the request type and the limit for each job
+	JobType JobTypeFunc
+
+	// Number of jobs run in parallel by the pool. By default: 1
+	Workers int
+
+	// Error handler (optional)
+	ErrorHandler WorkerPoolErrorHandler
+}
+
+// Pool of workers running the jobs of a source, only if the limit of the job type allows it
+// The jobs limited are requeued with exponential backoff
+type WorkerPool struct {
+	// Configuration
+	config WorkerPoolConfig
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Map (Req type) -> Backoff to retry the limited jobs
+	backoffs map[string]*WorkerPoolBackoff
+}
+
+// Backoff to retry the limited jobs of a request type
+type WorkerPoolBackoff struct {
+	// Current delay
+	delay time.Duration
+
+	// Time when the backoff expires, since no job of the type was limited for longer than the max delay
+	expiration time.Time
+}
+
+// Creates worker pool
+// Parameters:
+// - config - Configuration of the pool
+// Call Run to start the workers
+func NewWorkerPool(config WorkerPoolConfig) *WorkerPool {
+	if config.Workers <= 0 {
+		config.Workers = DEFAULT_WORKER_POOL_WORKERS
+	}
+
+	return &WorkerPool{
+		config:   config,
+		mu:       &sync.Mutex{},
+		backoffs: make(map[string]*WorkerPoolBackoff),
+	}
+}
+
+// Runs the workers until the context finishes
+// Once finished, the running jobs have their context cancelled, and the call
+// returns after all of them return. The jobs taken but not started are requeued.
+// Parameters:
+// - ctx - Context to stop the workers
+func (pool *WorkerPool) Run(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < pool.config.Workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			pool.runWorker(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Runs a worker until the context finishes
+func (pool *WorkerPool) runWorker(ctx context.Context) {
+	backoff := WORKER_POOL_MIN_BACKOFF
+
+	for ctx.Err() == nil {
+		job, err := pool.config.Source.Next(ctx)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			pool.onError(nil, err)
+
+			// Wait before retrying, so a failing source is not called in a loop
+
+			if sleepContext(ctx, addJitter(backoff)) != nil {
+				return
+			}
+
+			backoff = min(backoff*2, WORKER_POOL_MAX_BACKOFF)
+
+			continue
+		}
+
+		backoff = WORKER_POOL_MIN_BACKOFF
+
+		pool.runJob(ctx, job)
+	}
+}
+
+// Runs a job, if the limit of its type allows it. Requeues it otherwise
+func (pool *WorkerPool) runJob(ctx context.Context, job Job) {
+	requestType, limit := pool.config.JobType(job)
+
+	if requestType == "" {
+		pool.onJobDone(job, job.Run(ctx))
+		return
+	}
+
+	res, err := pool.config.Client.StartRequestContext(ctx, requestType, limit)
+
+	if err != nil {
+		if ctx.Err() == nil {
+			pool.onError(job, err)
+			pool.requeue(job, pool.nextBackoff(requestType, 0))
+		} else {
+			// Stopped before starting
+			pool.requeue(job, 0)
+		}
+
+		return
+	}
+
+	if res.Limited {
+		pool.requeue(job, pool.nextBackoff(requestType, res.RetryAfter))
+		return
+	}
+
+	pool.resetBackoff(requestType)
+
+	if ctx.Err() != nil {
+		// Stopped while starting
+		res.Request.End()
+		pool.requeue(job, 0)
+		return
+	}
+
+	pool.onJobDone(job, runStartedRequest(ctx, res.Request, job.Run))
+}
+
+// Requeues a job into the source
+func (pool *WorkerPool) requeue(job Job, delay time.Duration) {
+	err := pool.config.Source.Requeue(job, delay)
+
+	if err != nil {
+		pool.onError(job, err)
+	}
+}
+
+// Gets the delay to retry a limited job, increasing the backoff of its type
+// Parameters:
+// - requestType - Request type of the job
+// - retryAfter - Time estimated by the server. 0 if unknown
+func (pool *WorkerPool) nextBackoff(requestType string, retryAfter time.Duration) time.Duration {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := time.Now()
+	delay := WORKER_POOL_MIN_BACKOFF
+
+	b := pool.backoffs[requestType]
+
+	if b != nil && now.Before(b.expiration) {
+		delay = b.delay
+	}
+
+	if b == nil && len(pool.backoffs) >= WORKER_POOL_MAX_BACKOFF_TYPES {
+		pool.removeExpiredBackoffs(now)
+	}
+
+	if b != nil || len(pool.backoffs) < WORKER_POOL_MAX_BACKOFF_TYPES {
+		pool.backoffs[requestType] = &WorkerPoolBackoff{
+			delay:      min(delay*2, WORKER_POOL_MAX_BACKOFF),
+			expiration: now.Add(2 * WORKER_POOL_MAX_BACKOFF),
+		}
+	}
+
+	return addJitter(min(max(delay, retryAfter), WORKER_POOL_MAX_BACKOFF))
+}
+
+// Removes the expired backoffs, of the types not limited recently
+// Call with the mutex locked
+func (pool *WorkerPool) removeExpiredBackoffs(now time.Time) {
+	for requestType, b := range pool.backoffs {
+		if !now.Before(b.expiration) {
+			delete(pool.backoffs, requestType)
+		}
+	}
+}
+
+// Resets the backoff of a type, once a job of the type is started
+func (pool *WorkerPool) resetBackoff(requestType string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	delete(pool.backoffs, requestType)
+}
+
+// Called when a job finishes
+func (pool *WorkerPool) onJobDone(job Job, err error) {
+	if err != nil {
+		pool.onError(job, err)
+	}
+}
+
+// Calls the error handler, if set
+func (pool *WorkerPool) onError(job Job, err error) {
+	if pool.config.ErrorHandler != nil {
+		pool.config.ErrorHandler.OnJobError(job, err)
+	}
+}
@@ -0,0 +1,171 @@
+// Worker pool test
+
+package prc_client
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testJobSource struct {
+	jobs     chan Job
+	requeued *atomic.Int32
+}
+
+func (source *testJobSource) Next(ctx context.Context) (Job, error) {
+	select {
+	case job := <-source.jobs:
+		return job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (source *testJobSource) Requeue(job Job, delay time.Duration) error {
+	source.requeued.Add(1)
+
+	time.AfterFunc(delay, func() {
+		source.jobs <- job
+	})
+
+	return nil
+}
+
+type testJob struct {
+	running    *atomic.Int32
+	maxRunning *atomic.Int32
+	done       chan struct{}
+}
+
+func (job *testJob) Run(ctx context.Context) error {
+	running := job.running.Add(1)
+
+	if running > job.maxRunning.Load() {
+		job.maxRunning.Store(running)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	job.running.Add(-1)
+
+	job.done <- struct{}{}
+
+	return nil
+}
+
+func TestWorkerPool(t *testing.T) {
+	th := &testErrorHandler{
+		t: t,
+	}
+
+	cli := NewClient(&ClientConfig{
+		Url:          testServer.Url(),
+		AuthToken:    testServer.AuthToken(),
+		ErrorHandler: th,
+	})
+
+	cli.Connect()
+
+	rType := "test-worker-pool-type"
+	jobsCount := 3
+
+	source := &testJobSource{
+		jobs:     make(chan Job, jobsCount),
+		requeued: &atomic.Int32{},
+	}
+
+	running := &atomic.Int32{}
+	maxRunning := &atomic.Int32{}
+	done := make(chan struct{}, jobsCount)
+
+	for i := 0; i < jobsCount; i++ {
+		source.jobs <- &testJob{
+			running:    running,
+			maxRunning: maxRunning,
+			done:       done,
+		}
+	}
+
+	pool := NewWorkerPool(WorkerPoolConfig{
+		Client: cli,
+		Source: source,
+		JobType: func(job Job) (string, uint32) {
+			return rType, 1
+		},
+		Workers: jobsCount,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+
+	go func() {
+		pool.Run(ctx)
+		close(stopped)
+	}()
+
+	// Every job runs, one at a time
+
+	for i := 0; i < jobsCount; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("Timed out waiting for the jobs")
+			cancel()
+			return
+		}
+	}
+
+	assert.Equal(t, maxRunning.Load(), int32(1))
+	assert.Greater(t, source.requeued.Load(), int32(0))
+
+	waitForRequestCount(t, cli, rType, 0)
+
+	// Stops on context cancel
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the pool to stop")
+	}
+
+	cli.Close()
+}
+
+func TestWorkerPoolBackoffs(t *testing.T) {
+	pool := NewWorkerPool(WorkerPoolConfig{})
+
+	// The backoff of a type grows
+
+	assert.LessOrEqual(t, pool.nextBackoff("test-type", 0), WORKER_POOL_MIN_BACKOFF)
+	assert.GreaterOrEqual(t, pool.nextBackoff("test-type", 0), WORKER_POOL_MIN_BACKOFF)
+
+	pool.resetBackoff("test-type")
+
+	assert.Equal(t, len(pool.backoffs), 0)
+
+	// The number of types is bounded
+
+	for i := 0; i < WORKER_POOL_MAX_BACKOFF_TYPES+10; i++ {
+		pool.nextBackoff(fmt.Sprint("test-type-", i), 0)
+	}
+
+	assert.Equal(t, len(pool.backoffs), WORKER_POOL_MAX_BACKOFF_TYPES)
+
+	// The expired backoffs are replaced
+
+	for _, b := range pool.backoffs {
+		b.expiration = time.Now()
+	}
+
+	pool.nextBackoff("test-type", 0)
+
+	assert.Equal(t, len(pool.backoffs), 1)
+}
@@ -3,39 +3,69 @@
 package main
 
 import (
-	"sync"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/AgustinSRG/parallel-request-controller/server/prc_server"
 	"github.com/joho/godotenv"
 )
 
+// Max time to wait for the connections to be closed on shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func main() {
 	godotenv.Load() // Load env vars
 
 	// Configure logs
-	SetDebugLogEnabled(GetEnvBool("LOG_DEBUG", false))
-	SetInfoLogEnabled(GetEnvBool("LOG_INFO", true))
+	logger := prc_server.NewStandardLogger(GetEnvBool("LOG_INFO", true), GetEnvBool("LOG_DEBUG", false))
+
+	// Time to keep the freezes of a disconnected client
+	freezeReleaseDelay := time.Duration(GetEnvInt("FREEZE_RELEASE_DELAY_SECONDS", 30)) * time.Second
 
-	// Setup request controller
-	requestController := CreateRequestController()
+	if freezeReleaseDelay <= 0 {
+		freezeReleaseDelay = -1 // Release right away
+	}
 
 	// Setup server
-	server := CreateHttpServer(HttpServerConfig{
-		Port:               GetEnvInt("PORT", 8080),
-		BindAddress:        GetEnvString("BIND_ADDRESS", ""),
-		TlsEnabled:         GetEnvBool("TLS_ENABLED", false),
-		TlsCertificateFile: GetEnvString("TLS_CERTIFICATE", ""),
-		TlsPrivateKeyFile:  GetEnvString("TLS_PRIVATE_KEY", ""),
-		AuthToken:          GetEnvString("AUTH_TOKEN", ""),
-	}, requestController)
+	server := prc_server.CreateHttpServer(prc_server.HttpServerOptions{
+		Port:                GetEnvInt("PORT", 8080),
+		BindAddress:         GetEnvString("BIND_ADDRESS", ""),
+		TlsEnabled:          GetEnvBool("TLS_ENABLED", false),
+		TlsCertificateFile:  GetEnvString("TLS_CERTIFICATE", ""),
+		TlsPrivateKeyFile:   GetEnvString("TLS_PRIVATE_KEY", ""),
+		AuthToken:           GetEnvString("AUTH_TOKEN", ""),
+		AllowForcedRequests: GetEnvBool("ALLOW_FORCED_REQUESTS", false),
+		FreezeReleaseDelay:  freezeReleaseDelay,
+		Logger:              logger,
+	})
 
 	// Run server
 
-	wg := &sync.WaitGroup{}
+	err := server.Start()
+
+	if err != nil {
+		logger.Error(err, "Error starting the server")
+		os.Exit(1)
+	}
+
+	// Wait for a termination signal
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	<-signals
+
+	logger.Info("Shutting down...")
 
-	wg.Add(1)
-	go server.Run(wg)
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
 
-	// Wait for all threads to finish
+	err = server.Shutdown(ctx)
 
-	wg.Wait()
+	if err != nil {
+		logger.Error(err, "Error shutting down the server")
+	}
 }
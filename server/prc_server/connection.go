@@ -0,0 +1,1204 @@
+// Connection handler
+
+package prc_server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+	"github.com/gorilla/websocket"
+)
+
+// Period to send HEARTBEAT messages to the client
+const HEARTBEAT_MSG_PERIOD_SECONDS = 30
+
+// Max time with no HEARTBEAT messages to consider the connection dead
+const HEARTBEAT_TIMEOUT_MS = 2 * HEARTBEAT_MSG_PERIOD_SECONDS * 1000
+
+// Default page size for listing request counts
+const DEFAULT_COUNTS_PAGE_SIZE = 1000
+
+// Max page size for listing request counts
+const MAX_COUNTS_PAGE_SIZE = 10000
+
+// Max debounce delay for request count watches
+const MAX_WATCH_DEBOUNCE_MS = 60 * 1000
+
+// Max number of permits leased by a single LEASE-PERMITS message
+const MAX_LEASE_PERMITS = 1000
+
+// Request being handled
+type ActiveRequest struct {
+	// Request type
+	requestType string
+
+	// Number of slots taken by the request
+	weight uint32
+
+	// Time when the request started
+	startTime time.Time
+}
+
+// Watch of a request type
+type RequestTypeWatch struct {
+	// Delay to wait before notifying a change
+	debounce time.Duration
+
+	// True if a notification is already scheduled
+	scheduled bool
+}
+
+// Connection handler
+type ConnectionHandler struct {
+	// Connection id
+	id uint64
+
+	// Connection
+	connection *websocket.Conn
+
+	// HTTP server
+	server *HttpServer
+
+	// Request controller
+	requestController *RequestController
+
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Timestamp: Last time a HEARTBEAT message was received
+	lastHeartbeat int64
+
+	// True if closed
+	closed bool
+
+	// Channel closed when the connection is closed
+	done chan struct{}
+
+	// Mutex for the requests map
+	muRequests *sync.Mutex
+
+	// Requests mapping ID -> Request
+	requests map[string]*ActiveRequest
+
+	// Leased permits mapping Type -> Number of permits (protected by muRequests)
+	leases map[string]uint32
+
+	// True if watching the freezes, in order to revoke the leased permits (protected by muRequests)
+	watchingFreezes bool
+
+	// Mutex for the watches map
+	muWatches *sync.Mutex
+
+	// Watches mapping Type -> Watch
+	watches map[string]*RequestTypeWatch
+
+	// Request types with a pending count notification (protected by muWatches)
+	pendingNotifications map[string]bool
+
+	// Channel to wake up the sender of the count notifications
+	notificationsReady chan struct{}
+
+	// Map (Query ID) -> Channel to cancel the wait, for the WAIT-DRAINED messages (protected by mu)
+	drainWaits map[string]chan struct{}
+
+	// Owners of the freezes made by the connection (protected by mu)
+	freezeOwners map[any]bool
+}
+
+// Owner of the freezes made with a Freeze-ID, kept while the client reconnects
+type freezeOwnerId string
+
+// Creates connection handler
+func CreateConnectionHandler(conn *websocket.Conn, server *HttpServer, requestController *RequestController) *ConnectionHandler {
+	return &ConnectionHandler{
+		id:                   0,
+		connection:           conn,
+		server:               server,
+		requestController:    requestController,
+		mu:                   &sync.Mutex{},
+		lastHeartbeat:        0,
+		closed:               false,
+		done:                 make(chan struct{}),
+		muRequests:           &sync.Mutex{},
+		requests:             make(map[string]*ActiveRequest),
+		leases:               make(map[string]uint32),
+		muWatches:            &sync.Mutex{},
+		watches:              make(map[string]*RequestTypeWatch),
+		pendingNotifications: make(map[string]bool),
+		notificationsReady:   make(chan struct{}, 1),
+		drainWaits:           make(map[string]chan struct{}),
+		freezeOwners:         make(map[any]bool),
+	}
+}
+
+func (ch *ConnectionHandler) LogError(err error, msg string) {
+	ch.server.logger.Error(err, "[Request: "+fmt.Sprint(ch.id)+"] "+msg)
+}
+
+func (ch *ConnectionHandler) LogInfo(msg string) {
+	ch.server.logger.Info("[Request: " + fmt.Sprint(ch.id) + "] " + msg)
+}
+
+func (ch *ConnectionHandler) LogDebug(msg string) {
+	ch.server.logger.Debug("[Request: " + fmt.Sprint(ch.id) + "] " + msg)
+}
+
+func (ch *ConnectionHandler) onClose() {
+	ch.mu.Lock()
+
+	ch.closed = true
+	close(ch.done)
+
+	freezeOwners := ch.freezeOwners
+	ch.freezeOwners = make(map[any]bool)
+
+	ch.mu.Unlock()
+
+	ch.ClearPendingRequests()
+	ch.ClearWatches()
+	ch.ReleaseFreezes(freezeOwners)
+
+	ch.requestController.RemoveFreezeWatcher(ch)
+}
+
+// Releases the freezes made by the connection
+// The freezes made with a Freeze-ID are kept for a while, so the client can resume them after reconnecting
+func (ch *ConnectionHandler) ReleaseFreezes(freezeOwners map[any]bool) {
+	ch.requestController.ReleaseFreezes(ch)
+
+	for owner := range freezeOwners {
+		if owner != any(ch) {
+			ch.requestController.ReleaseFreezesAfter(owner, ch.server.options.FreezeReleaseDelay)
+		}
+	}
+}
+
+func (ch *ConnectionHandler) ClearPendingRequests() {
+	ch.muRequests.Lock()
+	defer ch.muRequests.Unlock()
+
+	for rId, r := range ch.requests {
+		ch.requestController.EndWeightedRequest(r.requestType, r.weight)
+		delete(ch.requests, rId)
+	}
+
+	for rType, permits := range ch.leases {
+		ch.requestController.ReturnPermits(rType, permits)
+		delete(ch.leases, rType)
+	}
+}
+
+// Runs connection handler
+func (ch *ConnectionHandler) Run() {
+	defer func() {
+		if err := recover(); err != nil {
+			switch x := err.(type) {
+			case string:
+				ch.LogError(nil, "Error: "+x)
+			case error:
+				ch.LogError(x, "Connection closed with error")
+			default:
+				ch.LogError(nil, "Connection Crashed!")
+			}
+		}
+		ch.LogInfo("Connection closed.")
+		// Ensure connection is closed
+		ch.connection.Close()
+		// Release resources
+		ch.onClose()
+		ch.server.removeConnection(ch)
+	}()
+
+	// Get a connection ID
+	ch.id = ch.server.GetConnectionId()
+
+	c := ch.connection
+
+	ch.LogInfo("Connection established.")
+
+	ch.lastHeartbeat = time.Now().UnixMilli()
+	go ch.sendHeartbeatMessages()  // Start heartbeat sending
+	go ch.sendCountNotifications() // Start sending the count notifications
+
+	for {
+		mt, message, err := c.ReadMessage()
+		if err != nil {
+			break // Closed
+		}
+
+		if mt != websocket.TextMessage {
+			continue
+		}
+
+		if ch.server.logger.DebugEnabled() {
+			ch.LogDebug("<<< \n" + string(message))
+		}
+
+		msg := simple_rpc_message.ParseRPCMessage(string(message))
+
+		switch msg.Method {
+		case "HEARTBEAT":
+			ch.receiveHeartbeat()
+		case "START-REQUEST":
+			ch.receiveStartRequest(&msg)
+		case "END-REQUEST":
+			ch.receiveEndRequest(&msg)
+		case "GET-REQUEST-COUNT":
+			ch.receiveGetRequestCount(&msg)
+		case "GET-REQUEST-COUNTS":
+			ch.receiveGetRequestCounts(&msg)
+		case "WATCH-REQUEST-TYPE":
+			ch.receiveWatchRequestType(&msg)
+		case "UNWATCH-REQUEST-TYPE":
+			ch.receiveUnwatchRequestType(&msg)
+		case "FREEZE":
+			ch.receiveFreeze(&msg)
+		case "UNFREEZE":
+			ch.receiveUnfreeze(&msg)
+		case "WAIT-DRAINED":
+			ch.receiveWaitDrained(&msg)
+		case "CANCEL-WAIT-DRAINED":
+			ch.receiveCancelWaitDrained(&msg)
+		case "LEASE-PERMITS":
+			ch.receiveLeasePermits(&msg)
+		case "RETURN-PERMITS":
+			ch.receiveReturnPermits(&msg)
+		}
+	}
+}
+
+// Called when a HEARTBEAT message is received from the client
+func (ch *ConnectionHandler) receiveHeartbeat() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.lastHeartbeat = time.Now().UnixMilli()
+}
+
+func (ch *ConnectionHandler) AddRequest(requestId string, requestType string, weight uint32) bool {
+	ch.muRequests.Lock()
+	defer ch.muRequests.Unlock()
+
+	if ch.requests[requestId] != nil {
+		return false
+	}
+
+	ch.requests[requestId] = &ActiveRequest{
+		requestType: requestType,
+		weight:      weight,
+		startTime:   time.Now(),
+	}
+
+	return true
+}
+
+func (ch *ConnectionHandler) receiveStartRequest(msg *simple_rpc_message.RPCMessage) {
+	requestId := msg.GetParam("Request-ID")
+
+	if len(requestId) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-ID' for message 'START-REQUEST'")
+		return
+	}
+
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'START-REQUEST'")
+		return
+	}
+
+	requestLimitStr := msg.GetParam("Request-Limit")
+
+	requestLimit, err := strconv.ParseUint(requestLimitStr, 10, 32)
+
+	if err != nil {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Request-Limit' for message 'START-REQUEST' must be a valid integer")
+		return
+	}
+
+	requestWeight := uint64(1)
+
+	if requestWeightStr := msg.GetParam("Request-Weight"); requestWeightStr != "" {
+		requestWeight, err = strconv.ParseUint(requestWeightStr, 10, 32)
+
+		if err != nil || requestWeight == 0 {
+			ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Request-Weight' for message 'START-REQUEST' must be a valid positive integer")
+			return
+		}
+	}
+
+	// Checks if id is duplicated
+
+	available := ch.AddRequest(requestId, requestType, uint32(requestWeight))
+
+	if !available {
+		ch.SendErrorMessage(msg, "REQUEST_ID_DUPLICATED", "You sent multiple 'START-REQUEST' messages with the same request id. Only the first one applies. The rest will are dropped.")
+		return
+	}
+
+	// Checks limit
+
+	var result StartRequestResult
+
+	// Forced requests bypass the limit, so they are only accepted if enabled in the server options
+
+	if ch.server.options.AllowForcedRequests && strings.ToUpper(msg.GetParam("Request-Force")) == "TRUE" {
+		result = ch.requestController.ForceStartWeightedRequest(requestType, uint32(requestLimit), uint32(requestWeight))
+	} else {
+		result = ch.requestController.StartWeightedRequest(requestType, uint32(requestLimit), uint32(requestWeight))
+	}
+
+	limited := "FALSE"
+
+	if !result.Started {
+		limited = "TRUE"
+
+		// Not started, so it must not be ended
+		ch.RemoveRequest(requestId)
+	}
+
+	// Reply
+
+	params := map[string]string{
+		"Request-ID":            requestId,
+		"Request-Limit-Reached": limited,
+		"Request-Count":         fmt.Sprint(result.Count),
+		"Request-Limit":         fmt.Sprint(result.Limit),
+	}
+
+	if result.Frozen {
+		params["Request-Type-Frozen"] = "TRUE"
+	}
+
+	if result.RetryAfter > 0 {
+		params["Retry-After"] = fmt.Sprint(max(result.RetryAfter.Milliseconds(), 1))
+	}
+
+	replyMsg := simple_rpc_message.RPCMessage{
+		Method: "START-REQUEST-ACK",
+		Params: params,
+		Body:   "",
+	}
+
+	ch.Send(&replyMsg)
+}
+
+func (ch *ConnectionHandler) RemoveRequest(requestId string) *ActiveRequest {
+	ch.muRequests.Lock()
+	defer ch.muRequests.Unlock()
+
+	r := ch.requests[requestId]
+
+	if r == nil {
+		return nil
+	}
+
+	delete(ch.requests, requestId)
+
+	return r
+}
+
+// Releases slots of a request
+// If the request keeps any slot, it stays active
+// requestId - Request ID
+// weight - Number of slots to release. 0 to release all of them
+// Returns the request (nil if not found), the number of slots released and true if the request ended
+func (ch *ConnectionHandler) ReleaseRequestSlots(requestId string, weight uint32) (*ActiveRequest, uint32, bool) {
+	ch.muRequests.Lock()
+	defer ch.muRequests.Unlock()
+
+	r := ch.requests[requestId]
+
+	if r == nil {
+		return nil, 0, false
+	}
+
+	if weight > 0 && weight < r.weight {
+		r.weight -= weight
+		return r, weight, false
+	}
+
+	delete(ch.requests, requestId)
+
+	return r, r.weight, true
+}
+
+func (ch *ConnectionHandler) receiveEndRequest(msg *simple_rpc_message.RPCMessage) {
+	requestId := msg.GetParam("Request-ID")
+
+	if len(requestId) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-ID' for message 'END-REQUEST'")
+		return
+	}
+
+	releaseWeight := uint64(0)
+
+	if releaseWeightStr := msg.GetParam("Request-Weight"); releaseWeightStr != "" {
+		var err error
+		releaseWeight, err = strconv.ParseUint(releaseWeightStr, 10, 32)
+
+		if err != nil || releaseWeight == 0 {
+			ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Request-Weight' for message 'END-REQUEST' must be a valid positive integer")
+			return
+		}
+	}
+
+	r, released, ended := ch.ReleaseRequestSlots(requestId, uint32(releaseWeight))
+
+	if r == nil {
+		return // Multiple end requests ignored
+	}
+
+	if !ended {
+		// Partial release, the request keeps the rest of its slots
+		ch.requestController.EndWeightedRequest(r.requestType, released)
+		return
+	}
+
+	ch.requestController.RecordRequestDuration(r.requestType, time.Since(r.startTime))
+
+	switch strings.ToUpper(msg.GetParam("Request-Success")) {
+	case "TRUE":
+		ch.requestController.RecordRequestOutcome(r.requestType, true)
+	case "FALSE":
+		ch.requestController.RecordRequestOutcome(r.requestType, false)
+	}
+
+	ch.requestController.EndWeightedRequest(r.requestType, released)
+}
+
+func (ch *ConnectionHandler) receiveGetRequestCount(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'GET-REQUEST-COUNT'")
+		return
+	}
+
+	ch.SendRequestCount(requestType, msg.GetParam("Query-ID"))
+}
+
+// Sends REQUEST-COUNT message with the current count of a request type
+// queryId - Query ID to copy into the message. Empty for watch notifications
+func (ch *ConnectionHandler) SendRequestCount(requestType string, queryId string) {
+	count := ch.requestController.GetRequestCount(requestType)
+
+	params := map[string]string{
+		"Request-Type":  requestType,
+		"Request-Count": fmt.Sprint(count),
+	}
+
+	if len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	msg := simple_rpc_message.RPCMessage{
+		Method: "REQUEST-COUNT",
+		Params: params,
+		Body:   "",
+	}
+
+	ch.Send(&msg)
+}
+
+func (ch *ConnectionHandler) receiveGetRequestCounts(msg *simple_rpc_message.RPCMessage) {
+	var counts []RequestTypeCount
+	nextCursor := ""
+
+	if _, isList := msg.Params["request-type-prefix"]; isList {
+		pageSize := DEFAULT_COUNTS_PAGE_SIZE
+		pageSizeStr := msg.GetParam("Page-Size")
+
+		if len(pageSizeStr) > 0 {
+			ps, err := strconv.ParseUint(pageSizeStr, 10, 32)
+
+			if err != nil || ps == 0 {
+				ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Page-Size' for message 'GET-REQUEST-COUNTS' must be a valid positive integer")
+				return
+			}
+
+			pageSize = int(min(ps, MAX_COUNTS_PAGE_SIZE))
+		}
+
+		var more bool
+
+		counts, more = ch.requestController.ListRequestCounts(msg.GetParam("Request-Type-Prefix"), msg.GetParam("Cursor"), pageSize)
+
+		if more && len(counts) > 0 {
+			nextCursor = counts[len(counts)-1].RequestType
+		}
+	} else {
+		requestTypes := make([]string, 0)
+
+		for _, line := range strings.Split(msg.Body, "\n") {
+			requestType := strings.TrimSpace(line)
+
+			if len(requestType) > 0 {
+				requestTypes = append(requestTypes, requestType)
+			}
+		}
+
+		counts = ch.requestController.GetRequestCounts(requestTypes)
+	}
+
+	// Reply
+
+	params := map[string]string{}
+
+	if queryId := msg.GetParam("Query-ID"); len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	if len(nextCursor) > 0 {
+		params["Next-Cursor"] = nextCursor
+	}
+
+	body := make([]string, len(counts))
+
+	for i, c := range counts {
+		body[i] = c.RequestType + ": " + fmt.Sprint(c.Count)
+	}
+
+	replyMsg := simple_rpc_message.RPCMessage{
+		Method: "REQUEST-COUNTS",
+		Params: params,
+		Body:   strings.Join(body, "\n"),
+	}
+
+	ch.Send(&replyMsg)
+}
+
+func (ch *ConnectionHandler) receiveWatchRequestType(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'WATCH-REQUEST-TYPE'")
+		return
+	}
+
+	debounce := uint64(0)
+	debounceStr := msg.GetParam("Debounce")
+
+	if len(debounceStr) > 0 {
+		d, err := strconv.ParseUint(debounceStr, 10, 32)
+
+		if err != nil {
+			ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Debounce' for message 'WATCH-REQUEST-TYPE' must be a valid integer")
+			return
+		}
+
+		debounce = min(d, MAX_WATCH_DEBOUNCE_MS)
+	}
+
+	ch.muWatches.Lock()
+
+	watch := ch.watches[requestType]
+
+	if watch == nil {
+		watch = &RequestTypeWatch{
+			scheduled: false,
+		}
+		ch.watches[requestType] = watch
+	}
+
+	watch.debounce = time.Duration(debounce) * time.Millisecond
+
+	ch.muWatches.Unlock()
+
+	ch.requestController.AddWatcher(requestType, ch)
+
+	// Send the initial count
+
+	ch.SendRequestCount(requestType, "")
+}
+
+func (ch *ConnectionHandler) receiveUnwatchRequestType(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'UNWATCH-REQUEST-TYPE'")
+		return
+	}
+
+	ch.muWatches.Lock()
+
+	delete(ch.watches, requestType)
+
+	ch.muWatches.Unlock()
+
+	ch.requestController.RemoveWatcher(requestType, ch)
+}
+
+// Removes all the watches of the connection
+func (ch *ConnectionHandler) ClearWatches() {
+	ch.muWatches.Lock()
+	defer ch.muWatches.Unlock()
+
+	for rType := range ch.watches {
+		ch.requestController.RemoveWatcher(rType, ch)
+		delete(ch.watches, rType)
+	}
+}
+
+// Called by the request controller when the count of a watched type changes
+// The notification is queued, so a slow client does not block the request controller
+func (ch *ConnectionHandler) OnRequestCountChanged(requestType string) {
+	ch.muWatches.Lock()
+	defer ch.muWatches.Unlock()
+
+	watch := ch.watches[requestType]
+
+	if watch == nil {
+		return
+	}
+
+	if watch.debounce <= 0 {
+		ch.queueCountNotification(requestType)
+		return
+	}
+
+	if watch.scheduled {
+		return // The scheduled notification will send the latest count
+	}
+
+	watch.scheduled = true
+
+	time.AfterFunc(watch.debounce, func() {
+		ch.muWatches.Lock()
+		defer ch.muWatches.Unlock()
+
+		watch.scheduled = false
+
+		if ch.watches[requestType] == watch {
+			ch.queueCountNotification(requestType)
+		}
+	})
+}
+
+// Queues a count notification for a request type
+// Multiple notifications for the same type are coalesced, sending the latest count
+// Must be called with muWatches acquired
+func (ch *ConnectionHandler) queueCountNotification(requestType string) {
+	ch.pendingNotifications[requestType] = true
+
+	select {
+	case ch.notificationsReady <- struct{}{}:
+	default:
+		// The sender is already woken up
+	}
+}
+
+// Task to send the queued count notifications
+func (ch *ConnectionHandler) sendCountNotifications() {
+	for {
+		select {
+		case <-ch.notificationsReady:
+		case <-ch.done:
+			return
+		}
+
+		ch.muWatches.Lock()
+
+		requestTypes := make([]string, 0, len(ch.pendingNotifications))
+
+		for requestType := range ch.pendingNotifications {
+			if ch.watches[requestType] != nil {
+				requestTypes = append(requestTypes, requestType)
+			}
+		}
+
+		clear(ch.pendingNotifications)
+
+		ch.muWatches.Unlock()
+
+		for _, requestType := range requestTypes {
+			ch.SendRequestCount(requestType, "")
+		}
+	}
+}
+
+// Gets the target of a FREEZE or UNFREEZE message
+// Returns the request type or prefix, true if it is a prefix, and false if the message is not valid
+func (ch *ConnectionHandler) getFreezeTarget(msg *simple_rpc_message.RPCMessage) (target string, isPrefix bool, valid bool) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) > 0 {
+		return requestType, false, true
+	}
+
+	prefix := msg.GetParam("Request-Type-Prefix")
+
+	if len(prefix) > 0 {
+		return prefix, true, true
+	}
+
+	ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' or 'Request-Type-Prefix' for message '"+msg.Method+"'")
+
+	return "", false, false
+}
+
+// Gets the owner of a freeze made by a FREEZE message
+// The Freeze-ID parameter identifies the client across reconnections. Without it, the connection is the owner
+func (ch *ConnectionHandler) getFreezeOwner(msg *simple_rpc_message.RPCMessage) any {
+	freezeId := msg.GetParam("Freeze-ID")
+
+	if len(freezeId) == 0 {
+		return ch
+	}
+
+	return freezeOwnerId(freezeId)
+}
+
+// Sends the reply for a FREEZE or UNFREEZE message
+// frozen - For FREEZE-ACK, true if the target is frozen. Ignored for UNFREEZE-ACK
+func (ch *ConnectionHandler) sendFreezeAck(method string, queryId string, target string, isPrefix bool, frozen bool) {
+	params := map[string]string{}
+
+	if len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	if method == "FREEZE-ACK" {
+		if frozen {
+			params["Frozen"] = "TRUE"
+		} else {
+			params["Frozen"] = "FALSE"
+		}
+	}
+
+	if isPrefix {
+		params["Request-Type-Prefix"] = target
+	} else {
+		params["Request-Type"] = target
+	}
+
+	msg := simple_rpc_message.RPCMessage{
+		Method: method,
+		Params: params,
+		Body:   "",
+	}
+
+	ch.Send(&msg)
+}
+
+func (ch *ConnectionHandler) receiveFreeze(msg *simple_rpc_message.RPCMessage) {
+	target, isPrefix, valid := ch.getFreezeTarget(msg)
+
+	if !valid {
+		return
+	}
+
+	// The freeze is owned by the client, so it is removed if the client disconnects and does not come back
+
+	owner := ch.getFreezeOwner(msg)
+
+	ch.mu.Lock()
+	ch.freezeOwners[owner] = true
+	ch.mu.Unlock()
+
+	if strings.ToUpper(msg.GetParam("Freeze-Resume")) == "TRUE" {
+		// The client reconnected, so only keep the freeze if nobody removed it
+
+		var frozen bool
+
+		if isPrefix {
+			frozen = ch.requestController.ResumeFreezePrefix(target, owner)
+		} else {
+			frozen = ch.requestController.ResumeFreeze(target, owner)
+		}
+
+		if frozen {
+			ch.LogDebug("Resumed freeze: " + target)
+		} else {
+			ch.LogDebug("Freeze not resumed, since it was removed: " + target)
+		}
+
+		ch.sendFreezeAck("FREEZE-ACK", msg.GetParam("Query-ID"), target, isPrefix, frozen)
+		return
+	}
+
+	if isPrefix {
+		ch.requestController.FreezePrefixOwned(target, owner)
+		ch.LogInfo("Froze request type prefix: " + target)
+	} else {
+		ch.requestController.FreezeOwned(target, owner)
+		ch.LogInfo("Froze request type: " + target)
+	}
+
+	ch.sendFreezeAck("FREEZE-ACK", msg.GetParam("Query-ID"), target, isPrefix, true)
+}
+
+func (ch *ConnectionHandler) receiveUnfreeze(msg *simple_rpc_message.RPCMessage) {
+	target, isPrefix, valid := ch.getFreezeTarget(msg)
+
+	if !valid {
+		return
+	}
+
+	freezeId := msg.GetParam("Freeze-ID")
+
+	if len(freezeId) > 0 {
+		// Only remove the freeze of the client
+
+		if isPrefix {
+			ch.requestController.UnfreezePrefixOwned(target, freezeOwnerId(freezeId))
+		} else {
+			ch.requestController.UnfreezeOwned(target, freezeOwnerId(freezeId))
+		}
+
+		ch.LogDebug("Released freeze: " + target)
+	} else if isPrefix {
+		ch.requestController.UnfreezePrefix(target)
+		ch.LogInfo("Unfroze request type prefix: " + target)
+	} else {
+		ch.requestController.Unfreeze(target)
+		ch.LogInfo("Unfroze request type: " + target)
+	}
+
+	ch.sendFreezeAck("UNFREEZE-ACK", msg.GetParam("Query-ID"), target, isPrefix, false)
+}
+
+func (ch *ConnectionHandler) receiveWaitDrained(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'WAIT-DRAINED'")
+		return
+	}
+
+	timeout := uint64(0)
+	timeoutStr := msg.GetParam("Timeout")
+
+	if len(timeoutStr) > 0 {
+		t, err := strconv.ParseUint(timeoutStr, 10, 32)
+
+		if err != nil {
+			ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Timeout' for message 'WAIT-DRAINED' must be a valid integer")
+			return
+		}
+
+		timeout = t
+	}
+
+	queryId := msg.GetParam("Query-ID")
+
+	// The wait can be cancelled with the Query-ID
+
+	cancel := make(chan struct{})
+
+	if len(queryId) > 0 {
+		ch.mu.Lock()
+
+		if previous := ch.drainWaits[queryId]; previous != nil {
+			close(previous)
+		}
+
+		ch.drainWaits[queryId] = cancel
+
+		ch.mu.Unlock()
+	}
+
+	waiter := ch.requestController.WaitDrained(requestType)
+
+	go ch.waitDrained(waiter, requestType, queryId, time.Duration(timeout)*time.Millisecond, cancel)
+}
+
+func (ch *ConnectionHandler) receiveCancelWaitDrained(msg *simple_rpc_message.RPCMessage) {
+	queryId := msg.GetParam("Query-ID")
+
+	if len(queryId) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Query-ID' for message 'CANCEL-WAIT-DRAINED'")
+		return
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if cancel := ch.drainWaits[queryId]; cancel != nil {
+		close(cancel)
+		delete(ch.drainWaits, queryId)
+	}
+}
+
+// Waits for a request type to be drained, sending the DRAINED message after it
+// No message is sent if the wait is cancelled or the connection is closed
+func (ch *ConnectionHandler) waitDrained(waiter *DrainWaiter, requestType string, queryId string, timeout time.Duration, cancel chan struct{}) {
+	defer waiter.Cancel()
+
+	if len(queryId) > 0 {
+		defer func() {
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+
+			if ch.drainWaits[queryId] == cancel {
+				delete(ch.drainWaits, queryId)
+			}
+		}()
+	}
+
+	var timeoutChan <-chan time.Time = nil
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		timeoutChan = timer.C
+	}
+
+	drained := "TRUE"
+
+	select {
+	case <-waiter.Drained():
+	case <-timeoutChan:
+		drained = "FALSE"
+	case <-cancel:
+		return
+	case <-ch.done:
+		return
+	}
+
+	params := map[string]string{
+		"Request-Type":  requestType,
+		"Drained":       drained,
+		"Request-Count": fmt.Sprint(ch.requestController.GetRequestCount(requestType)),
+	}
+
+	if len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	replyMsg := simple_rpc_message.RPCMessage{
+		Method: "DRAINED",
+		Params: params,
+		Body:   "",
+	}
+
+	ch.Send(&replyMsg)
+}
+
+// Task to send HEARTBEAT periodically
+func (ch *ConnectionHandler) sendHeartbeatMessages() {
+	for {
+		time.Sleep(HEARTBEAT_MSG_PERIOD_SECONDS * time.Second)
+
+		if ch.closed {
+			return // Closed
+		}
+
+		// Send heartbeat message
+		msg := simple_rpc_message.RPCMessage{
+			Method: "HEARTBEAT",
+			Params: nil,
+			Body:   "",
+		}
+
+		ch.Send(&msg)
+
+		// Check heartbeat
+		ch.checkHeartbeat()
+	}
+}
+
+// Send error message
+// cause - Message that caused the error. Its Request-ID and Query-ID are copied, so the client can match the error
+func (ch *ConnectionHandler) SendErrorMessage(cause *simple_rpc_message.RPCMessage, errorCode string, errorMessage string) {
+	params := map[string]string{
+		"Error-Code":    errorCode,
+		"Error-Message": errorMessage,
+	}
+
+	if requestId := cause.GetParam("Request-ID"); len(requestId) > 0 {
+		params["Request-ID"] = requestId
+	}
+
+	if queryId := cause.GetParam("Query-ID"); len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	msg := simple_rpc_message.RPCMessage{
+		Method: "ERROR",
+		Params: params,
+		Body:   "",
+	}
+
+	ch.Send(&msg)
+}
+
+// Closes the connection
+// The requests of the client are released once the handler stops
+func (ch *ConnectionHandler) Close() {
+	ch.connection.Close()
+}
+
+// Sends a message to the websocket client
+func (ch *ConnectionHandler) Send(msg *simple_rpc_message.RPCMessage) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	if ch.server.logger.DebugEnabled() {
+		ch.LogDebug(">>> \n" + msg.Serialize())
+	}
+
+	ch.connection.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+}
+
+// Checks if the client is sending HEARTBEAT messages
+// If not, closes the connection
+func (ch *ConnectionHandler) checkHeartbeat() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	if (now - ch.lastHeartbeat) >= HEARTBEAT_TIMEOUT_MS {
+		ch.connection.Close()
+	}
+}
+
+func (ch *ConnectionHandler) receiveLeasePermits(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'LEASE-PERMITS'")
+		return
+	}
+
+	requestLimit, err := strconv.ParseUint(msg.GetParam("Request-Limit"), 10, 32)
+
+	if err != nil {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Request-Limit' for message 'LEASE-PERMITS' must be a valid integer")
+		return
+	}
+
+	permits, err := strconv.ParseUint(msg.GetParam("Permits"), 10, 32)
+
+	if err != nil || permits == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Permits' for message 'LEASE-PERMITS' must be a valid positive integer")
+		return
+	}
+
+	permits = min(permits, MAX_LEASE_PERMITS)
+
+	// The lease is registered before sending the reply, so it is released if the connection closes
+
+	ch.muRequests.Lock()
+
+	result := ch.requestController.LeasePermits(requestType, uint32(requestLimit), uint32(permits))
+
+	if result.Granted > 0 {
+		ch.leases[requestType] += result.Granted
+
+		if !ch.watchingFreezes {
+			// Revoke the permits if the type is frozen later
+			ch.requestController.AddFreezeWatcher(ch)
+			ch.watchingFreezes = true
+		}
+	}
+
+	ch.muRequests.Unlock()
+
+	params := map[string]string{
+		"Request-Type":  requestType,
+		"Permits":       fmt.Sprint(result.Granted),
+		"Request-Count": fmt.Sprint(result.Count),
+		"Request-Limit": fmt.Sprint(result.Limit),
+	}
+
+	if result.Frozen {
+		params["Request-Type-Frozen"] = "TRUE"
+	}
+
+	if result.RetryAfter > 0 {
+		params["Retry-After"] = fmt.Sprint(max(result.RetryAfter.Milliseconds(), 1))
+	}
+
+	if queryId := msg.GetParam("Query-ID"); len(queryId) > 0 {
+		params["Query-ID"] = queryId
+	}
+
+	ch.Send(&simple_rpc_message.RPCMessage{
+		Method: "PERMITS-LEASED",
+		Params: params,
+		Body:   "",
+	})
+
+	if result.Granted > 0 && ch.requestController.IsFrozen(requestType) {
+		// Frozen before sending the reply, so the revocation could reach the client before the permits
+		ch.OnFrozen(requestType, false)
+	}
+}
+
+// Called by the request controller when a request type or prefix is frozen
+// Tells the client to stop using the permits leased for the frozen types
+func (ch *ConnectionHandler) OnFrozen(target string, isPrefix bool) {
+	ch.muRequests.Lock()
+
+	revoked := make([]string, 0)
+
+	for requestType := range ch.leases {
+		if requestType == target || (isPrefix && strings.HasPrefix(requestType, target)) {
+			revoked = append(revoked, requestType)
+		}
+	}
+
+	ch.muRequests.Unlock()
+
+	if len(revoked) == 0 {
+		return
+	}
+
+	// Sent in background, so a slow client does not block the request controller
+
+	go func() {
+		for _, requestType := range revoked {
+			ch.Send(&simple_rpc_message.RPCMessage{
+				Method: "PERMITS-REVOKED",
+				Params: map[string]string{
+					"Request-Type": requestType,
+				},
+				Body: "",
+			})
+		}
+	}()
+}
+
+func (ch *ConnectionHandler) receiveReturnPermits(msg *simple_rpc_message.RPCMessage) {
+	requestType := msg.GetParam("Request-Type")
+
+	if len(requestType) == 0 {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Missing parameter 'Request-Type' for message 'RETURN-PERMITS'")
+		return
+	}
+
+	permits, err := strconv.ParseUint(msg.GetParam("Permits"), 10, 32)
+
+	if err != nil {
+		ch.SendErrorMessage(msg, "PROTOCOL_ERROR", "Parameter 'Permits' for message 'RETURN-PERMITS' must be a valid integer")
+		return
+	}
+
+	// Only the permits leased by the connection can be returned
+
+	ch.muRequests.Lock()
+
+	leased := ch.leases[requestType]
+	returned := min(uint32(permits), leased)
+
+	if returned == leased {
+		delete(ch.leases, requestType)
+	} else {
+		ch.leases[requestType] = leased - returned
+	}
+
+	ch.muRequests.Unlock()
+
+	ch.requestController.ReturnPermits(requestType, returned)
+}
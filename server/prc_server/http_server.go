@@ -0,0 +1,377 @@
+// HTTP server
+
+package prc_server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DEFAULT_HTTP_RESPONSE = "Parallel request controller server."
+
+const WS_PREFIX = "/ws/"
+
+// Default time to keep the freezes of a disconnected client
+const DEFAULT_FREEZE_RELEASE_DELAY = 30 * time.Second
+
+// Options of the server
+type HttpServerOptions struct {
+	// Server port. If 0, a free port is chosen (see Addr)
+	Port int
+
+	// Server bind address
+	BindAddress string
+
+	// TLS enabled?
+	TlsEnabled bool
+
+	// Certificate file
+	TlsCertificateFile string
+
+	// Key file
+	TlsPrivateKeyFile string
+
+	// Auth token
+	AuthToken string
+
+	// True to accept the Request-Force parameter of the START-REQUEST messages
+	// The clients use it to report the requests started while the server was unreachable,
+	// so any client could bypass the limits and the freezes. By default: false, so it is ignored
+	AllowForcedRequests bool
+
+	// Time to keep the freezes of a disconnected client, so it can resume them after reconnecting
+	// By default (0): DEFAULT_FREEZE_RELEASE_DELAY. If negative, the freezes are released right away
+	FreezeReleaseDelay time.Duration
+
+	// Logger. By default: a StandardLogger, with the information messages enabled
+	Logger Logger
+
+	// Request controller. By default: a new one
+	RequestController *RequestController
+}
+
+// HTTP websocket server
+type HttpServer struct {
+	// Server options
+	options HttpServerOptions
+
+	// Logger
+	logger Logger
+
+	// Mutex
+	mu *sync.Mutex
+
+	// Next connection ID
+	nextConnectionId uint64
+
+	// Websocket connection upgrader
+	upgrader *websocket.Upgrader
+
+	// Request controller
+	requestController *RequestController
+
+	// HTTP server, once started
+	httpServer *http.Server
+
+	// Listener, once started
+	listener net.Listener
+
+	// Active connections
+	connections map[*ConnectionHandler]bool
+
+	// Wait group for the active connections
+	connectionsWaitGroup *sync.WaitGroup
+
+	// True if shutting down
+	shuttingDown bool
+}
+
+// Creates HTTP server
+// Call Start to listen for connections, or use Handler to mount it into an existing HTTP server
+func CreateHttpServer(options HttpServerOptions) *HttpServer {
+	if options.Logger == nil {
+		options.Logger = NewStandardLogger(true, false)
+	}
+
+	if options.RequestController == nil {
+		options.RequestController = CreateRequestController()
+	}
+
+	if options.FreezeReleaseDelay == 0 {
+		options.FreezeReleaseDelay = DEFAULT_FREEZE_RELEASE_DELAY
+	}
+
+	if len(options.AuthToken) == 0 {
+		options.Logger.Warning("The auth token is empty. It is required for clients to authenticate. Please, set it before starting the server.")
+	}
+
+	return &HttpServer{
+		options:              options,
+		logger:               options.Logger,
+		upgrader:             &websocket.Upgrader{},
+		mu:                   &sync.Mutex{},
+		nextConnectionId:     0,
+		requestController:    options.RequestController,
+		connections:          make(map[*ConnectionHandler]bool),
+		connectionsWaitGroup: &sync.WaitGroup{},
+	}
+}
+
+// Gets the request controller of the server
+func (server *HttpServer) RequestController() *RequestController {
+	return server.requestController
+}
+
+// Gets the HTTP handler of the server, in order to mount it into an existing HTTP server
+// The websocket connections are accepted in the path /ws/{AUTH_TOKEN}, so use
+// http.StripPrefix if the handler is mounted under a prefix
+func (server *HttpServer) Handler() http.Handler {
+	return server
+}
+
+// Gets an unique ID for a connection
+func (server *HttpServer) GetConnectionId() uint64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	id := server.nextConnectionId
+
+	server.nextConnectionId++
+
+	return id
+}
+
+// Adds an active connection
+// Returns false if the server is shutting down
+func (server *HttpServer) addConnection(ch *ConnectionHandler) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.shuttingDown {
+		return false
+	}
+
+	server.connections[ch] = true
+	server.connectionsWaitGroup.Add(1)
+
+	return true
+}
+
+// Removes an active connection, once closed
+func (server *HttpServer) removeConnection(ch *ConnectionHandler) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if !server.connections[ch] {
+		return
+	}
+
+	delete(server.connections, ch)
+	server.connectionsWaitGroup.Done()
+}
+
+// Serves HTTP request
+func (server *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		server.logger.Error(err, "Error parsing request IP")
+		w.WriteHeader(200)
+		fmt.Fprint(w, DEFAULT_HTTP_RESPONSE)
+		return
+	}
+
+	server.logger.Info("[HTTP] [FROM: " + ip + "] " + req.Method + " " + req.URL.Path)
+
+	if strings.HasPrefix(req.URL.Path, WS_PREFIX) {
+		authToken := getAuthTokenFromPath(req.URL.Path)
+
+		// Check auth token
+		if subtle.ConstantTimeCompare([]byte(server.options.AuthToken), []byte(authToken)) != 1 {
+			w.WriteHeader(403)
+			server.logger.Debug("[HTTP] [FROM: " + ip + "] [FORBIDDEN] " + req.Method + " " + req.URL.Path)
+			fmt.Fprint(w, "Forbidden.")
+			return
+		}
+
+		// Upgrade connection
+
+		c, err := server.upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			server.logger.Error(err, "Error upgrading connection")
+			return
+		}
+
+		// Handle connection
+		ch := CreateConnectionHandler(c, server, server.requestController)
+
+		if !server.addConnection(ch) {
+			c.Close()
+			return
+		}
+
+		go ch.Run()
+	} else {
+		w.WriteHeader(200)
+		fmt.Fprint(w, DEFAULT_HTTP_RESPONSE)
+	}
+}
+
+// Starts listening for connections
+// The connections are served in the background, until Shutdown is called
+// Returns an error if the server could not listen (port in use, invalid certificate, ...)
+func (server *HttpServer) Start() error {
+	addr := net.JoinHostPort(server.options.BindAddress, strconv.Itoa(server.options.Port))
+
+	var tlsConfig *tls.Config = nil
+
+	if server.options.TlsEnabled {
+		certificate, err := tls.LoadX509KeyPair(server.options.TlsCertificateFile, server.options.TlsPrivateKeyFile)
+
+		if err != nil {
+			return err
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		server.logger.Info("[HTTPS] Listening on " + listener.Addr().String())
+	} else {
+		server.logger.Info("[HTTP] Listening on " + listener.Addr().String())
+	}
+
+	httpServer := &http.Server{
+		Handler: server,
+	}
+
+	server.mu.Lock()
+	server.httpServer = httpServer
+	server.listener = listener
+	server.mu.Unlock()
+
+	go func() {
+		err := httpServer.Serve(listener)
+
+		if err != nil && err != http.ErrServerClosed {
+			server.logger.Error(err, "Error serving HTTP requests")
+		}
+	}()
+
+	return nil
+}
+
+// Gets the address the server is listening on
+// Returns nil if not started
+func (server *HttpServer) Addr() net.Addr {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.listener == nil {
+		return nil
+	}
+
+	return server.listener.Addr()
+}
+
+// Stops the server
+// Stops listening, closes the websocket connections, and waits for their requests to be released
+// Parameters:
+// - ctx - Context to limit the wait
+// Returns the context error if it finished before the connections were closed,
+// or the error of the HTTP server shutdown. The websocket connections are closed in both cases
+func (server *HttpServer) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+
+	server.shuttingDown = true
+
+	httpServer := server.httpServer
+
+	connections := make([]*ConnectionHandler, 0, len(server.connections))
+
+	for ch := range server.connections {
+		connections = append(connections, ch)
+	}
+
+	server.mu.Unlock()
+
+	var shutdownErr error
+
+	if httpServer != nil {
+		shutdownErr = httpServer.Shutdown(ctx)
+	}
+
+	// The websocket connections are not closed by the HTTP server, even if it failed to shut down
+
+	for _, ch := range connections {
+		ch.Close()
+	}
+
+	if shutdownErr != nil {
+		// Closing the sockets makes the handlers return, so their requests are released right away
+		server.connectionsWaitGroup.Wait()
+
+		return shutdownErr
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		server.connectionsWaitGroup.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Gets authentication token from PATH
+func getAuthTokenFromPath(path string) string {
+	if len(path) <= len(WS_PREFIX) {
+		return ""
+	}
+
+	authPart := path[len(WS_PREFIX):]
+
+	if len(authPart) == 0 {
+		return ""
+	}
+
+	authPartSplit := strings.Split(authPart, "/")
+
+	if len(authPartSplit) == 0 {
+		return ""
+	}
+
+	token, err := url.PathUnescape(authPartSplit[0])
+
+	if err != nil {
+		return ""
+	}
+
+	return token
+}
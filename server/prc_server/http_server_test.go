@@ -0,0 +1,319 @@
+// HTTP server test
+
+package prc_server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	simple_rpc_message "github.com/AgustinSRG/go-simple-rpc-message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func testWebsocketStartRequest(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := simple_rpc_message.RPCMessage{
+		Method: "START-REQUEST",
+		Params: map[string]string{
+			"Request-ID":    "1",
+			"Request-Type":  "test-type",
+			"Request-Limit": "10",
+		},
+	}
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := simple_rpc_message.ParseRPCMessage(string(data))
+
+		if reply.Method == "START-REQUEST-ACK" {
+			assert.Equal(t, reply.GetParam("Request-Limit-Reached"), "FALSE")
+			return conn
+		}
+	}
+}
+
+func TestHttpServerStartShutdown(t *testing.T) {
+	server := CreateHttpServer(HttpServerOptions{
+		BindAddress: "127.0.0.1",
+		AuthToken:   "test-token",
+		Logger:      DiscardLogger{},
+	})
+
+	err := server.Start()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := testWebsocketStartRequest(t, "ws://"+server.Addr().String()+"/ws/test-token")
+	defer conn.Close()
+
+	assert.Equal(t, server.RequestController().GetRequestCount("test-type"), uint32(1))
+
+	// Shutdown closes the connections, releasing the requests
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, server.RequestController().GetRequestCount("test-type"), uint32(0))
+
+	_, _, err = websocket.DefaultDialer.Dial("ws://"+server.Addr().String()+"/ws/test-token", nil)
+
+	assert.Error(t, err)
+}
+
+func TestHttpServerShutdownError(t *testing.T) {
+	server := CreateHttpServer(HttpServerOptions{
+		BindAddress: "127.0.0.1",
+		AuthToken:   "test-token",
+		Logger:      DiscardLogger{},
+	})
+
+	err := server.Start()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := testWebsocketStartRequest(t, "ws://"+server.Addr().String()+"/ws/test-token")
+	defer conn.Close()
+
+	// A connection with no request keeps the HTTP server from shutting down before the context ends
+
+	idleConn, err := net.Dial("tcp", server.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idleConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The websocket connections are closed anyway, releasing the requests
+
+	assert.Equal(t, server.RequestController().GetRequestCount("test-type"), uint32(0))
+}
+
+func TestHttpServerHandler(t *testing.T) {
+	server := CreateHttpServer(HttpServerOptions{
+		AuthToken: "test-token",
+		Logger:    DiscardLogger{},
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/prc/", http.StripPrefix("/prc", server.Handler()))
+
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/prc/ws/"
+
+	// Invalid token
+
+	_, res, err := websocket.DefaultDialer.Dial(url+"invalid", nil)
+
+	assert.Error(t, err)
+
+	if res != nil {
+		assert.Equal(t, res.StatusCode, http.StatusForbidden)
+	}
+
+	conn := testWebsocketStartRequest(t, url+"test-token")
+	defer conn.Close()
+
+	assert.Equal(t, server.RequestController().GetRequestCount("test-type"), uint32(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, server.RequestController().GetRequestCount("test-type"), uint32(0))
+}
+
+func testWebsocketForcedRequest(t *testing.T, url string) (limited string) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	msg := simple_rpc_message.RPCMessage{
+		Method: "START-REQUEST",
+		Params: map[string]string{
+			"Request-ID":    "1",
+			"Request-Type":  "test-forced-type",
+			"Request-Limit": "0",
+			"Request-Force": "TRUE",
+		},
+	}
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := simple_rpc_message.ParseRPCMessage(string(data))
+
+		if reply.Method == "START-REQUEST-ACK" {
+			return reply.GetParam("Request-Limit-Reached")
+		}
+	}
+}
+
+func TestHttpServerForcedRequests(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		server := CreateHttpServer(HttpServerOptions{
+			AuthToken:           "test-token",
+			AllowForcedRequests: allow,
+			Logger:              DiscardLogger{},
+		})
+
+		httpServer := httptest.NewServer(server.Handler())
+
+		limited := testWebsocketForcedRequest(t, "ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws/test-token")
+
+		if allow {
+			assert.Equal(t, limited, "FALSE")
+		} else {
+			assert.Equal(t, limited, "TRUE")
+		}
+
+		httpServer.Close()
+	}
+}
+
+func testWebsocketSend(t *testing.T, conn *websocket.Conn, method string, params map[string]string) {
+	msg := simple_rpc_message.RPCMessage{
+		Method: method,
+		Params: params,
+	}
+
+	err := conn.WriteMessage(websocket.TextMessage, []byte(msg.Serialize()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpServerPartialEndRequest(t *testing.T) {
+	server := CreateHttpServer(HttpServerOptions{
+		AuthToken: "test-token",
+		Logger:    DiscardLogger{},
+	})
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws/test-token", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	rc := server.RequestController()
+
+	waitCount := func(expected uint32) {
+		assert.Eventually(t, func() bool {
+			return rc.GetRequestCount("test-partial-type") == expected
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	testWebsocketSend(t, conn, "START-REQUEST", map[string]string{
+		"Request-ID":     "1",
+		"Request-Type":   "test-partial-type",
+		"Request-Limit":  "10",
+		"Request-Weight": "3",
+	})
+
+	waitCount(3)
+
+	// Releases some of the slots
+
+	testWebsocketSend(t, conn, "END-REQUEST", map[string]string{
+		"Request-ID":     "1",
+		"Request-Weight": "1",
+	})
+
+	waitCount(2)
+
+	// Releasing more slots than taken ends the request
+
+	testWebsocketSend(t, conn, "END-REQUEST", map[string]string{
+		"Request-ID":     "1",
+		"Request-Weight": "5",
+	})
+
+	waitCount(0)
+
+	// Already ended
+
+	testWebsocketSend(t, conn, "END-REQUEST", map[string]string{
+		"Request-ID": "1",
+	})
+
+	testWebsocketSend(t, conn, "START-REQUEST", map[string]string{
+		"Request-ID":     "2",
+		"Request-Type":   "test-partial-type",
+		"Request-Limit":  "10",
+		"Request-Weight": "2",
+	})
+
+	waitCount(2)
+
+	testWebsocketSend(t, conn, "END-REQUEST", map[string]string{
+		"Request-ID": "2",
+	})
+
+	waitCount(0)
+}
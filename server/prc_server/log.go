@@ -0,0 +1,90 @@
+// Logs
+// Any utils to log events must be placed here
+
+package prc_server
+
+import (
+	"log"
+)
+
+// Logger for the server events
+type Logger interface {
+	// Logs an error. The err parameter may be nil
+	Error(err error, msg string)
+
+	// Logs a warning
+	Warning(msg string)
+
+	// Logs an information message
+	Info(msg string)
+
+	// Logs a debug message
+	Debug(msg string)
+
+	// Checks if the debug messages are logged
+	// Used to skip building expensive debug messages
+	DebugEnabled() bool
+}
+
+// Logger using the standard log package
+type StandardLogger struct {
+	// True to log the information messages
+	infoEnabled bool
+
+	// True to log the debug messages
+	debugEnabled bool
+}
+
+// Creates logger using the standard log package
+// Parameters:
+// - infoEnabled - True to log the information messages
+// - debugEnabled - True to log the debug messages
+func NewStandardLogger(infoEnabled bool, debugEnabled bool) *StandardLogger {
+	return &StandardLogger{
+		infoEnabled:  infoEnabled,
+		debugEnabled: debugEnabled,
+	}
+}
+
+func (logger *StandardLogger) Error(err error, msg string) {
+	if err != nil {
+		log.Println("[ERROR] " + msg + " | " + err.Error())
+	} else {
+		log.Println("[ERROR] " + msg)
+	}
+}
+
+func (logger *StandardLogger) Warning(msg string) {
+	log.Println("[WARNING] " + msg)
+}
+
+func (logger *StandardLogger) Info(msg string) {
+	if logger.infoEnabled {
+		log.Println("[INFO] " + msg)
+	}
+}
+
+func (logger *StandardLogger) Debug(msg string) {
+	if logger.debugEnabled {
+		log.Println("[DEBUG] " + msg)
+	}
+}
+
+func (logger *StandardLogger) DebugEnabled() bool {
+	return logger.debugEnabled
+}
+
+// Logger discarding every message
+type DiscardLogger struct{}
+
+func (logger DiscardLogger) Error(err error, msg string) {}
+
+func (logger DiscardLogger) Warning(msg string) {}
+
+func (logger DiscardLogger) Info(msg string) {}
+
+func (logger DiscardLogger) Debug(msg string) {}
+
+func (logger DiscardLogger) DebugEnabled() bool {
+	return false
+}
@@ -0,0 +1,922 @@
+// Request controller
+
+package prc_server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Weight of the last sample for the average request duration
+const DURATION_AVERAGE_WEIGHT = 0.2
+
+// Time to keep the duration stats for a type with no requests
+const DURATION_STATS_TTL = 10 * time.Minute
+
+// Result of trying to start a request
+type StartRequestResult struct {
+	// True if the request was started
+	Started bool
+
+	// True if the request was rejected because the type is frozen
+	Frozen bool
+
+	// Number of requests of the type, after the start attempt
+	Count uint32
+
+	// Limit enforced for the type
+	Limit uint32
+
+	// Estimated time until a request of the type can be started.
+	// Only set if the request was not started, and there is enough data.
+	RetryAfter time.Duration
+}
+
+// Result of a permits lease
+type LeasePermitsResult struct {
+	// Number of permits granted. 0 if the limit was reached or the type is frozen
+	Granted uint32
+
+	// True if no permits were granted because the type is frozen
+	Frozen bool
+
+	// Number of requests of the type, including the leased permits, after the lease
+	Count uint32
+
+	// Limit of the request type
+	Limit uint32
+
+	// Estimated time until a permit of the type can be leased.
+	// Only set if no permits were granted, and there is enough data.
+	RetryAfter time.Duration
+}
+
+// Duration stats for a request type
+type RequestDurationStats struct {
+	// Average duration of the requests
+	averageDuration time.Duration
+
+	// Average rate of failed requests (0 to 1), for the requests reporting the outcome
+	failureRate float64
+
+	// True if any request reported the outcome
+	hasOutcome bool
+
+	// Last time the stats were updated
+	lastUpdate time.Time
+}
+
+// Count of a request type
+type RequestTypeCount struct {
+	// Request type
+	RequestType string
+
+	// Number of requests of the type
+	Count uint32
+}
+
+// Watcher of request count changes
+type RequestCountWatcher interface {
+	// Called after the count of a watched request type changes
+	// The call is made after releasing the lock, so the watcher
+	// is allowed to call the request controller
+	OnRequestCountChanged(requestType string)
+}
+
+// Watcher of freezes
+type FreezeWatcher interface {
+	// Called after a request type or prefix is frozen
+	// The call is made after releasing the lock, so the watcher
+	// is allowed to call the request controller
+	OnFrozen(target string, isPrefix bool)
+}
+
+// Request controller
+type RequestController struct {
+	// Mutex for the struct
+	mu *sync.Mutex
+
+	// Map (Req type) -> Count
+	counts map[string]uint32
+
+	// Map (Req type) -> Set of watchers
+	watchers map[string]map[RequestCountWatcher]bool
+
+	// Map (Req type) -> Set of owners of the freeze
+	frozenTypes map[string]map[any]bool
+
+	// Map (Req type prefix) -> Set of owners of the freeze
+	frozenPrefixes map[string]map[any]bool
+
+	// Map (Owner) -> Timer to release the freezes of the owner
+	freezeReleaseTimers map[any]*time.Timer
+
+	// Set of freeze watchers
+	freezeWatchers map[FreezeWatcher]bool
+
+	// Map (Req type) -> Duration stats
+	durations map[string]*RequestDurationStats
+
+	// Last time the stale duration stats were removed
+	lastDurationsCleanup time.Time
+}
+
+// Creates instance of RequestController
+func CreateRequestController() *RequestController {
+	return &RequestController{
+		mu:                   &sync.Mutex{},
+		counts:               make(map[string]uint32),
+		watchers:             make(map[string]map[RequestCountWatcher]bool),
+		frozenTypes:          make(map[string]map[any]bool),
+		frozenPrefixes:       make(map[string]map[any]bool),
+		freezeReleaseTimers:  make(map[any]*time.Timer),
+		freezeWatchers:       make(map[FreezeWatcher]bool),
+		durations:            make(map[string]*RequestDurationStats),
+		lastDurationsCleanup: time.Now(),
+	}
+}
+
+// Tries to start a request
+// requestType - Request type
+// limit - Max number of request for requestType
+// Returns true if success, false if the limit was reached or the type is frozen
+func (rc *RequestController) TryStartRequest(requestType string, limit uint32) bool {
+	return rc.StartRequest(requestType, limit).Started
+}
+
+// Tries to start a request, returning the details of the result
+// requestType - Request type
+// limit - Max number of request for requestType
+func (rc *RequestController) StartRequest(requestType string, limit uint32) StartRequestResult {
+	return rc.StartWeightedRequest(requestType, limit, 1)
+}
+
+// Tries to start a request taking several slots of the limit
+// requestType - Request type
+// limit - Max number of request for requestType
+// weight - Number of slots taken by the request (min 1)
+func (rc *RequestController) StartWeightedRequest(requestType string, limit uint32, weight uint32) StartRequestResult {
+	weight = max(weight, 1)
+
+	rc.mu.Lock()
+
+	c := rc.counts[requestType]
+
+	if c >= limit || limit-c < weight || rc.isFrozen(requestType) {
+		result := StartRequestResult{
+			Started:    false,
+			Frozen:     rc.isFrozen(requestType),
+			Count:      c,
+			Limit:      limit,
+			RetryAfter: 0,
+		}
+
+		if !result.Frozen && weight <= limit {
+			// Room is needed for all the slots of the request
+			result.RetryAfter = rc.estimateRetryAfter(requestType, c, limit-weight+1)
+		}
+
+		rc.mu.Unlock()
+
+		return result
+	}
+
+	rc.counts[requestType] = c + weight
+
+	watchers := rc.getWatchers(requestType)
+
+	rc.mu.Unlock()
+
+	notifyRequestCountChanged(watchers, requestType)
+
+	return StartRequestResult{
+		Started:    true,
+		Frozen:     false,
+		Count:      c + weight,
+		Limit:      limit,
+		RetryAfter: 0,
+	}
+}
+
+// Ends a request
+// requestType - Request type
+func (rc *RequestController) EndRequest(requestType string) {
+	rc.releaseRequests(requestType, 1)
+}
+
+// Ends a request taking several slots of the limit
+// requestType - Request type
+// weight - Number of slots taken by the request (min 1)
+func (rc *RequestController) EndWeightedRequest(requestType string, weight uint32) {
+	rc.releaseRequests(requestType, max(weight, 1))
+}
+
+// Leases a block of permits for a request type
+// Each permit is counted as a request until returned, so the limit holds for every client
+// requestType - Request type
+// limit - Max number of request for requestType
+// permits - Number of permits requested. Less may be granted, if there is no room for all of them
+func (rc *RequestController) LeasePermits(requestType string, limit uint32, permits uint32) LeasePermitsResult {
+	rc.mu.Lock()
+
+	c := rc.counts[requestType]
+
+	if c >= limit || permits == 0 || rc.isFrozen(requestType) {
+		result := LeasePermitsResult{
+			Granted:    0,
+			Frozen:     rc.isFrozen(requestType),
+			Count:      c,
+			Limit:      limit,
+			RetryAfter: 0,
+		}
+
+		if !result.Frozen && c >= limit {
+			result.RetryAfter = rc.estimateRetryAfter(requestType, c, limit)
+		}
+
+		rc.mu.Unlock()
+
+		return result
+	}
+
+	granted := min(permits, limit-c)
+
+	rc.counts[requestType] = c + granted
+
+	watchers := rc.getWatchers(requestType)
+
+	rc.mu.Unlock()
+
+	notifyRequestCountChanged(watchers, requestType)
+
+	return LeasePermitsResult{
+		Granted:    granted,
+		Frozen:     false,
+		Count:      c + granted,
+		Limit:      limit,
+		RetryAfter: 0,
+	}
+}
+
+// Returns leased permits
+// requestType - Request type
+// permits - Number of permits to return
+func (rc *RequestController) ReturnPermits(requestType string, permits uint32) {
+	rc.releaseRequests(requestType, permits)
+}
+
+// Decreases the count of a request type
+// requestType - Request type
+// n - Number of requests to release
+func (rc *RequestController) releaseRequests(requestType string, n uint32) {
+	if n == 0 {
+		return
+	}
+
+	rc.mu.Lock()
+
+	c := rc.counts[requestType]
+
+	if c == 0 {
+		rc.mu.Unlock()
+		return
+	}
+
+	if c <= n {
+		delete(rc.counts, requestType)
+	} else {
+		rc.counts[requestType] = c - n
+	}
+
+	watchers := rc.getWatchers(requestType)
+
+	rc.mu.Unlock()
+
+	notifyRequestCountChanged(watchers, requestType)
+}
+
+// Starts a request ignoring the limit and the freezes
+// Used to account for requests that were already started by a client while the server was unreachable
+// requestType - Request type
+// limit - Max number of request for requestType, only used for the result
+func (rc *RequestController) ForceStartRequest(requestType string, limit uint32) StartRequestResult {
+	return rc.ForceStartWeightedRequest(requestType, limit, 1)
+}
+
+// Starts a request taking several slots of the limit, ignoring the limit and the freezes
+// requestType - Request type
+// limit - Max number of request for requestType, only used for the result
+// weight - Number of slots taken by the request (min 1)
+func (rc *RequestController) ForceStartWeightedRequest(requestType string, limit uint32, weight uint32) StartRequestResult {
+	rc.mu.Lock()
+
+	c := rc.counts[requestType] + max(weight, 1)
+
+	rc.counts[requestType] = c
+
+	watchers := rc.getWatchers(requestType)
+
+	rc.mu.Unlock()
+
+	notifyRequestCountChanged(watchers, requestType)
+
+	return StartRequestResult{
+		Started:    true,
+		Frozen:     false,
+		Count:      c,
+		Limit:      limit,
+		RetryAfter: 0,
+	}
+}
+
+// Records the duration of a request that ended, used to estimate when a limited type will have room
+// requestType - Request type
+// duration - Time between the start and the end of the request
+func (rc *RequestController) RecordRequestDuration(requestType string, duration time.Duration) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+
+	stats := rc.durations[requestType]
+
+	if stats == nil {
+		rc.durations[requestType] = &RequestDurationStats{
+			averageDuration: duration,
+			lastUpdate:      now,
+		}
+	} else {
+		stats.averageDuration = time.Duration(DURATION_AVERAGE_WEIGHT*float64(duration) + (1-DURATION_AVERAGE_WEIGHT)*float64(stats.averageDuration))
+		stats.lastUpdate = now
+	}
+
+	// Remove stale stats
+
+	if now.Sub(rc.lastDurationsCleanup) >= DURATION_STATS_TTL {
+		rc.lastDurationsCleanup = now
+
+		for rType, stats := range rc.durations {
+			if rc.counts[rType] == 0 && now.Sub(stats.lastUpdate) >= DURATION_STATS_TTL {
+				delete(rc.durations, rType)
+			}
+		}
+	}
+}
+
+// Records the outcome of a request that ended, in order to track the failure rate of the type
+// requestType - Request type
+// success - True if the request succeeded
+func (rc *RequestController) RecordRequestOutcome(requestType string, success bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	failure := 0.0
+
+	if !success {
+		failure = 1
+	}
+
+	stats := rc.durations[requestType]
+
+	if stats == nil {
+		stats = &RequestDurationStats{}
+		rc.durations[requestType] = stats
+	}
+
+	if stats.hasOutcome {
+		stats.failureRate = DURATION_AVERAGE_WEIGHT*failure + (1-DURATION_AVERAGE_WEIGHT)*stats.failureRate
+	} else {
+		stats.failureRate = failure
+		stats.hasOutcome = true
+	}
+
+	stats.lastUpdate = time.Now()
+}
+
+// Gets the average rate of failed requests of a type (0 to 1)
+// Returns false if no request of the type reported the outcome
+func (rc *RequestController) GetFailureRate(requestType string) (float64, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	stats := rc.durations[requestType]
+
+	if stats == nil || !stats.hasOutcome {
+		return 0, false
+	}
+
+	return stats.failureRate, true
+}
+
+// Gets the average duration of the requests of a type
+// Returns 0 if there is no data for the type
+func (rc *RequestController) GetAverageDuration(requestType string) time.Duration {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	stats := rc.durations[requestType]
+
+	if stats == nil {
+		return 0
+	}
+
+	return stats.averageDuration
+}
+
+// Estimates the time until a request of a limited type can be started
+// Assumes the requests in progress are evenly spread along the average duration
+// Must be called with the lock acquired
+// Returns 0 if there is not enough data
+func (rc *RequestController) estimateRetryAfter(requestType string, count uint32, limit uint32) time.Duration {
+	stats := rc.durations[requestType]
+
+	if stats == nil || count == 0 || limit == 0 {
+		return 0
+	}
+
+	// Number of requests that must end before having room for a new one
+	needed := count - limit + 1
+
+	return stats.averageDuration * time.Duration(needed) / time.Duration(count+1)
+}
+
+// Returns the current count for a request type
+func (rc *RequestController) GetRequestCount(requestType string) uint32 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.counts[requestType]
+}
+
+// Returns the current counts for a list of request types, read at the same time
+// requestTypes - List of request types
+// Returns the counts, in the same order as requestTypes
+func (rc *RequestController) GetRequestCounts(requestTypes []string) []RequestTypeCount {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	result := make([]RequestTypeCount, len(requestTypes))
+
+	for i, requestType := range requestTypes {
+		result[i] = RequestTypeCount{
+			RequestType: requestType,
+			Count:       rc.counts[requestType],
+		}
+	}
+
+	return result
+}
+
+// Lists the current counts for the request types starting with a prefix, read at the same time
+// Only the types with requests being handled are listed
+// prefix - Request type prefix. Empty to list every type
+// after - Only list types sorted after this one. Used for pagination
+// pageSize - Max number of types to return
+// Returns the counts sorted by request type, and true if there are more types to list
+func (rc *RequestController) ListRequestCounts(prefix string, after string, pageSize int) (counts []RequestTypeCount, more bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	types := make([]string, 0)
+
+	for requestType := range rc.counts {
+		if strings.HasPrefix(requestType, prefix) && requestType > after {
+			types = append(types, requestType)
+		}
+	}
+
+	sort.Strings(types)
+
+	if len(types) > pageSize {
+		types = types[:pageSize]
+		more = true
+	}
+
+	counts = make([]RequestTypeCount, len(types))
+
+	for i, requestType := range types {
+		counts[i] = RequestTypeCount{
+			RequestType: requestType,
+			Count:       rc.counts[requestType],
+		}
+	}
+
+	return counts, more
+}
+
+// Adds a watcher for a request type
+// requestType - Request type
+// watcher - Watcher to be notified when the count changes
+func (rc *RequestController) AddWatcher(requestType string, watcher RequestCountWatcher) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	w := rc.watchers[requestType]
+
+	if w == nil {
+		w = make(map[RequestCountWatcher]bool)
+		rc.watchers[requestType] = w
+	}
+
+	w[watcher] = true
+}
+
+// Removes a watcher for a request type
+// requestType - Request type
+// watcher - Watcher to remove
+func (rc *RequestController) RemoveWatcher(requestType string, watcher RequestCountWatcher) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	w := rc.watchers[requestType]
+
+	if w == nil {
+		return
+	}
+
+	delete(w, watcher)
+
+	if len(w) == 0 {
+		delete(rc.watchers, requestType)
+	}
+}
+
+// Gets a copy of the list of watchers for a request type
+// Must be called with the lock acquired
+func (rc *RequestController) getWatchers(requestType string) []RequestCountWatcher {
+	w := rc.watchers[requestType]
+
+	if len(w) == 0 {
+		return nil
+	}
+
+	result := make([]RequestCountWatcher, 0, len(w))
+
+	for watcher := range w {
+		result = append(result, watcher)
+	}
+
+	return result
+}
+
+// Notifies a list of watchers about a request count change
+func notifyRequestCountChanged(watchers []RequestCountWatcher, requestType string) {
+	for _, watcher := range watchers {
+		watcher.OnRequestCountChanged(requestType)
+	}
+}
+
+// Adds a watcher for the freezes
+// watcher - Watcher to be notified when a request type or prefix is frozen
+func (rc *RequestController) AddFreezeWatcher(watcher FreezeWatcher) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.freezeWatchers[watcher] = true
+}
+
+// Removes a watcher for the freezes
+// watcher - Watcher to remove
+func (rc *RequestController) RemoveFreezeWatcher(watcher FreezeWatcher) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.freezeWatchers, watcher)
+}
+
+// Gets a copy of the list of freeze watchers
+// Must be called with the lock acquired
+func (rc *RequestController) getFreezeWatchers() []FreezeWatcher {
+	if len(rc.freezeWatchers) == 0 {
+		return nil
+	}
+
+	result := make([]FreezeWatcher, 0, len(rc.freezeWatchers))
+
+	for watcher := range rc.freezeWatchers {
+		result = append(result, watcher)
+	}
+
+	return result
+}
+
+// Notifies a list of watchers about a freeze
+func notifyFrozen(watchers []FreezeWatcher, target string, isPrefix bool) {
+	for _, watcher := range watchers {
+		watcher.OnFrozen(target, isPrefix)
+	}
+}
+
+// Freezes a request type, rejecting any new request of the type
+// The freeze stays until Unfreeze is called
+// requestType - Request type
+func (rc *RequestController) Freeze(requestType string) {
+	rc.FreezeOwned(requestType, nil)
+}
+
+// Freezes a request type on behalf of an owner (for example, a client)
+// The freeze stays until Unfreeze is called, or until ReleaseFreezes is called for every owner
+// Cancels the scheduled release of the freezes of the owner
+// requestType - Request type
+// owner - Owner of the freeze. nil for a freeze not released by ReleaseFreezes
+func (rc *RequestController) FreezeOwned(requestType string, owner any) {
+	rc.mu.Lock()
+
+	addFreezeOwner(rc.frozenTypes, requestType, owner)
+	rc.cancelFreezesRelease(owner)
+
+	watchers := rc.getFreezeWatchers()
+
+	rc.mu.Unlock()
+
+	notifyFrozen(watchers, requestType, false)
+}
+
+// Resumes the freeze of a request type by an owner, after the owner reconnects
+// Cancels the scheduled release of the freezes of the owner
+// requestType - Request type
+// owner - Owner of the freeze
+// Returns true if the type is still frozen by the owner. False if it was unfrozen or released
+func (rc *RequestController) ResumeFreeze(requestType string, owner any) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.resumeFreeze(rc.frozenTypes, requestType, owner)
+}
+
+// Removes an owner from the freeze of a request type
+// The type stays frozen while it has other owners
+// requestType - Request type
+// owner - Owner of the freeze
+func (rc *RequestController) UnfreezeOwned(requestType string, owner any) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	removeTargetFreezeOwner(rc.frozenTypes, requestType, owner)
+}
+
+// Unfreezes a request type, regardless of the owners of the freeze
+// requestType - Request type
+func (rc *RequestController) Unfreeze(requestType string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.frozenTypes, requestType)
+}
+
+// Freezes every request type starting with a prefix
+// The freeze stays until UnfreezePrefix is called
+// prefix - Request type prefix
+func (rc *RequestController) FreezePrefix(prefix string) {
+	rc.FreezePrefixOwned(prefix, nil)
+}
+
+// Freezes every request type starting with a prefix, on behalf of an owner (for example, a client)
+// The freeze stays until UnfreezePrefix is called, or until ReleaseFreezes is called for every owner
+// Cancels the scheduled release of the freezes of the owner
+// prefix - Request type prefix
+// owner - Owner of the freeze. nil for a freeze not released by ReleaseFreezes
+func (rc *RequestController) FreezePrefixOwned(prefix string, owner any) {
+	rc.mu.Lock()
+
+	addFreezeOwner(rc.frozenPrefixes, prefix, owner)
+	rc.cancelFreezesRelease(owner)
+
+	watchers := rc.getFreezeWatchers()
+
+	rc.mu.Unlock()
+
+	notifyFrozen(watchers, prefix, true)
+}
+
+// Resumes the freeze of a request type prefix by an owner, after the owner reconnects
+// Cancels the scheduled release of the freezes of the owner
+// prefix - Request type prefix
+// owner - Owner of the freeze
+// Returns true if the prefix is still frozen by the owner. False if it was unfrozen or released
+func (rc *RequestController) ResumeFreezePrefix(prefix string, owner any) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.resumeFreeze(rc.frozenPrefixes, prefix, owner)
+}
+
+// Removes an owner from the freeze of a request type prefix
+// The prefix stays frozen while it has other owners
+// prefix - Request type prefix
+// owner - Owner of the freeze
+func (rc *RequestController) UnfreezePrefixOwned(prefix string, owner any) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	removeTargetFreezeOwner(rc.frozenPrefixes, prefix, owner)
+}
+
+// Unfreezes a request type prefix, regardless of the owners of the freeze
+// prefix - Request type prefix
+func (rc *RequestController) UnfreezePrefix(prefix string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.frozenPrefixes, prefix)
+}
+
+// Removes an owner from every freeze
+// The types and prefixes stay frozen while they have other owners
+// owner - Owner of the freezes
+func (rc *RequestController) ReleaseFreezes(owner any) {
+	if owner == nil {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.cancelFreezesRelease(owner)
+
+	removeFreezeOwner(rc.frozenTypes, owner)
+	removeFreezeOwner(rc.frozenPrefixes, owner)
+}
+
+// Removes an owner from every freeze after a delay, unless the owner freezes or resumes a freeze before
+// Used when the owner disconnects, so its freezes stay while it reconnects
+// owner - Owner of the freezes
+// delay - Time to wait. If not positive, the freezes are released right away
+func (rc *RequestController) ReleaseFreezesAfter(owner any, delay time.Duration) {
+	if owner == nil {
+		return
+	}
+
+	if delay <= 0 {
+		rc.ReleaseFreezes(owner)
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.cancelFreezesRelease(owner)
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(delay, func() {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+
+		if rc.freezeReleaseTimers[owner] != timer {
+			return // Cancelled
+		}
+
+		delete(rc.freezeReleaseTimers, owner)
+
+		removeFreezeOwner(rc.frozenTypes, owner)
+		removeFreezeOwner(rc.frozenPrefixes, owner)
+	})
+
+	rc.freezeReleaseTimers[owner] = timer
+}
+
+// Cancels the scheduled release of the freezes of an owner
+// Must be called with the lock acquired
+func (rc *RequestController) cancelFreezesRelease(owner any) {
+	if timer := rc.freezeReleaseTimers[owner]; timer != nil {
+		timer.Stop()
+		delete(rc.freezeReleaseTimers, owner)
+	}
+}
+
+// Resumes the freeze of a request type or prefix by an owner
+// Must be called with the lock acquired
+func (rc *RequestController) resumeFreeze(freezes map[string]map[any]bool, target string, owner any) bool {
+	if !freezes[target][owner] {
+		return false
+	}
+
+	rc.cancelFreezesRelease(owner)
+
+	return true
+}
+
+// Adds an owner to the freeze of a request type or prefix
+func addFreezeOwner(freezes map[string]map[any]bool, target string, owner any) {
+	owners := freezes[target]
+
+	if owners == nil {
+		owners = make(map[any]bool)
+		freezes[target] = owners
+	}
+
+	owners[owner] = true
+}
+
+// Removes an owner from the freeze of a request type or prefix, removing the freeze if left without owners
+func removeTargetFreezeOwner(freezes map[string]map[any]bool, target string, owner any) {
+	owners := freezes[target]
+
+	if owners == nil {
+		return
+	}
+
+	delete(owners, owner)
+
+	if len(owners) == 0 {
+		delete(freezes, target)
+	}
+}
+
+// Removes an owner from a set of freezes, removing the freezes left without owners
+func removeFreezeOwner(freezes map[string]map[any]bool, owner any) {
+	for target, owners := range freezes {
+		if !owners[owner] {
+			continue
+		}
+
+		delete(owners, owner)
+
+		if len(owners) == 0 {
+			delete(freezes, target)
+		}
+	}
+}
+
+// Checks if a request type is frozen
+func (rc *RequestController) IsFrozen(requestType string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.isFrozen(requestType)
+}
+
+// Checks if a request type is frozen
+// Must be called with the lock acquired
+func (rc *RequestController) isFrozen(requestType string) bool {
+	if rc.frozenTypes[requestType] != nil {
+		return true
+	}
+
+	for prefix := range rc.frozenPrefixes {
+		if strings.HasPrefix(requestType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Waiter for a request type to be drained (count reaching zero)
+type DrainWaiter struct {
+	// Request controller
+	rc *RequestController
+
+	// Request type
+	requestType string
+
+	// Channel closed when drained
+	drained chan struct{}
+
+	// Once to close the channel
+	once *sync.Once
+}
+
+// Creates a waiter for a request type to be drained
+// requestType - Request type
+// Call Cancel() on the waiter when no longer needed
+func (rc *RequestController) WaitDrained(requestType string) *DrainWaiter {
+	waiter := &DrainWaiter{
+		rc:          rc,
+		requestType: requestType,
+		drained:     make(chan struct{}),
+		once:        &sync.Once{},
+	}
+
+	rc.AddWatcher(requestType, waiter)
+
+	// Check in case it was already drained
+
+	waiter.OnRequestCountChanged(requestType)
+
+	return waiter
+}
+
+// Returns a channel closed when the request type is drained
+func (waiter *DrainWaiter) Drained() <-chan struct{} {
+	return waiter.drained
+}
+
+// Stops watching the request type
+func (waiter *DrainWaiter) Cancel() {
+	waiter.rc.RemoveWatcher(waiter.requestType, waiter)
+}
+
+// Called when the count of the request type changes
+func (waiter *DrainWaiter) OnRequestCountChanged(requestType string) {
+	if waiter.rc.GetRequestCount(requestType) > 0 {
+		return
+	}
+
+	waiter.once.Do(func() {
+		close(waiter.drained)
+	})
+}
@@ -0,0 +1,492 @@
+// Request controller tests
+
+package prc_server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type AtomicCounter struct {
+	mu    *sync.Mutex
+	count int
+}
+
+func CreateAtomicCounter() *AtomicCounter {
+	return &AtomicCounter{
+		mu:    &sync.Mutex{},
+		count: 0,
+	}
+}
+
+func (ac *AtomicCounter) Get() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	return ac.count
+}
+
+func (ac *AtomicCounter) Increment() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ac.count += 1
+}
+
+func testStartRequest(wg *sync.WaitGroup, ac *AtomicCounter, requestController *RequestController, rType string, limit uint32) {
+	defer wg.Done()
+
+	r := requestController.TryStartRequest(rType, limit)
+
+	if r {
+		ac.Increment()
+	}
+}
+
+func TestRequestController(t *testing.T) {
+	requestController := CreateRequestController()
+	ac := CreateAtomicCounter()
+	wg := &sync.WaitGroup{}
+	wg.Add(3)
+
+	rType := "test-type"
+	limit := uint32(2)
+
+	// Start requests
+
+	go testStartRequest(wg, ac, requestController, rType, limit)
+	go testStartRequest(wg, ac, requestController, rType, limit)
+	go testStartRequest(wg, ac, requestController, rType, limit)
+
+	wg.Wait()
+
+	assert.Equal(t, ac.Get(), 2)
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(2))
+
+	// End requests
+
+	requestController.EndRequest(rType)
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(1))
+
+	requestController.EndRequest(rType)
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(0))
+
+	requestController.EndRequest(rType)
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(0))
+}
+
+type testWatcher struct {
+	changes *AtomicCounter
+}
+
+func (tw *testWatcher) OnRequestCountChanged(requestType string) {
+	tw.changes.Increment()
+}
+
+func TestRequestControllerWatchers(t *testing.T) {
+	requestController := CreateRequestController()
+	watcher := &testWatcher{
+		changes: CreateAtomicCounter(),
+	}
+
+	rType := "test-type"
+	limit := uint32(1)
+
+	requestController.AddWatcher(rType, watcher)
+
+	// Changes notify the watcher
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.Equal(t, watcher.changes.Get(), 1)
+
+	// Limited requests do not change the count
+
+	assert.False(t, requestController.TryStartRequest(rType, limit))
+	assert.Equal(t, watcher.changes.Get(), 1)
+
+	// Other types do not notify the watcher
+
+	assert.True(t, requestController.TryStartRequest("other-type", limit))
+	assert.Equal(t, watcher.changes.Get(), 1)
+
+	requestController.EndRequest(rType)
+	assert.Equal(t, watcher.changes.Get(), 2)
+
+	// Removed watchers are not notified
+
+	requestController.RemoveWatcher(rType, watcher)
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.Equal(t, watcher.changes.Get(), 2)
+}
+
+func TestRequestControllerFreeze(t *testing.T) {
+	requestController := CreateRequestController()
+
+	limit := uint32(10)
+
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	// Frozen types reject new requests
+
+	requestController.Freeze("tenant1-a")
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.True(t, requestController.TryStartRequest("tenant1-b", limit))
+
+	requestController.Unfreeze("tenant1-a")
+
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	// Frozen prefixes reject every matching type
+
+	requestController.FreezePrefix("tenant1-")
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.False(t, requestController.TryStartRequest("tenant1-c", limit))
+	assert.True(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	requestController.UnfreezePrefix("tenant1-")
+
+	assert.True(t, requestController.TryStartRequest("tenant1-c", limit))
+
+	// Owned freezes are removed when released by every owner
+
+	owner1 := &struct{ id int }{id: 1}
+	owner2 := &struct{ id int }{id: 2}
+
+	requestController.FreezeOwned("tenant1-a", owner1)
+	requestController.FreezeOwned("tenant1-a", owner2)
+	requestController.FreezePrefixOwned("tenant2-", owner1)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.False(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	requestController.ReleaseFreezes(owner1)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.True(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	requestController.ReleaseFreezes(owner2)
+
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	// Freezes without owner are not released
+
+	requestController.Freeze("tenant1-a")
+	requestController.FreezeOwned("tenant1-a", owner1)
+	requestController.ReleaseFreezes(owner1)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	requestController.Unfreeze("tenant1-a")
+
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+}
+
+func TestRequestControllerFreezeRelease(t *testing.T) {
+	requestController := CreateRequestController()
+
+	limit := uint32(10)
+
+	owner1 := &struct{ id int }{id: 1}
+	owner2 := &struct{ id int }{id: 2}
+
+	// Delayed releases keep the freezes until the delay passes
+
+	requestController.FreezeOwned("tenant1-a", owner1)
+	requestController.FreezePrefixOwned("tenant2-", owner1)
+	requestController.ReleaseFreezesAfter(owner1, 50*time.Millisecond)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.False(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	assert.Eventually(t, func() bool {
+		return requestController.TryStartRequest("tenant1-a", limit)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.True(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	// Resuming a freeze cancels the release
+
+	requestController.FreezeOwned("tenant1-a", owner1)
+	requestController.ReleaseFreezesAfter(owner1, 50*time.Millisecond)
+
+	assert.True(t, requestController.ResumeFreeze("tenant1-a", owner1))
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	// Removed freezes are not resumed
+
+	requestController.Unfreeze("tenant1-a")
+
+	assert.False(t, requestController.ResumeFreeze("tenant1-a", owner1))
+	assert.False(t, requestController.ResumeFreezePrefix("tenant2-", owner1))
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+
+	// Owned unfreezes only remove the freeze of the owner
+
+	requestController.FreezeOwned("tenant1-a", owner1)
+	requestController.FreezeOwned("tenant1-a", owner2)
+	requestController.FreezePrefixOwned("tenant2-", owner1)
+
+	requestController.UnfreezeOwned("tenant1-a", owner1)
+	requestController.UnfreezePrefixOwned("tenant2-", owner1)
+
+	assert.False(t, requestController.TryStartRequest("tenant1-a", limit))
+	assert.True(t, requestController.TryStartRequest("tenant2-a", limit))
+
+	requestController.UnfreezeOwned("tenant1-a", owner2)
+
+	assert.True(t, requestController.TryStartRequest("tenant1-a", limit))
+}
+
+func TestRequestControllerWaitDrained(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+	limit := uint32(2)
+
+	// Already drained
+
+	waiter := requestController.WaitDrained(rType)
+
+	select {
+	case <-waiter.Drained():
+	default:
+		t.Error("Expected the waiter to be drained")
+	}
+
+	waiter.Cancel()
+
+	// Drained after the requests end
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+
+	waiter = requestController.WaitDrained(rType)
+	defer waiter.Cancel()
+
+	requestController.EndRequest(rType)
+
+	select {
+	case <-waiter.Drained():
+		t.Error("Expected the waiter not to be drained")
+	default:
+	}
+
+	requestController.EndRequest(rType)
+
+	select {
+	case <-waiter.Drained():
+	case <-time.After(time.Second):
+		t.Error("Expected the waiter to be drained")
+	}
+}
+
+func TestRequestControllerListRequestCounts(t *testing.T) {
+	requestController := CreateRequestController()
+
+	limit := uint32(10)
+
+	requestController.TryStartRequest("tenant1-a", limit)
+	requestController.TryStartRequest("tenant1-b", limit)
+	requestController.TryStartRequest("tenant1-b", limit)
+	requestController.TryStartRequest("tenant1-c", limit)
+	requestController.TryStartRequest("tenant2-a", limit)
+
+	// Multiple types
+
+	counts := requestController.GetRequestCounts([]string{"tenant1-b", "tenant2-a", "tenant3-a"})
+
+	assert.Equal(t, counts, []RequestTypeCount{
+		{RequestType: "tenant1-b", Count: 2},
+		{RequestType: "tenant2-a", Count: 1},
+		{RequestType: "tenant3-a", Count: 0},
+	})
+
+	// Prefix, with pagination
+
+	counts, more := requestController.ListRequestCounts("tenant1-", "", 2)
+
+	assert.True(t, more)
+	assert.Equal(t, counts, []RequestTypeCount{
+		{RequestType: "tenant1-a", Count: 1},
+		{RequestType: "tenant1-b", Count: 2},
+	})
+
+	counts, more = requestController.ListRequestCounts("tenant1-", "tenant1-b", 2)
+
+	assert.False(t, more)
+	assert.Equal(t, counts, []RequestTypeCount{
+		{RequestType: "tenant1-c", Count: 1},
+	})
+
+	// Every type
+
+	counts, more = requestController.ListRequestCounts("", "", 10)
+
+	assert.False(t, more)
+	assert.Equal(t, len(counts), 4)
+}
+
+func TestRequestControllerStartRequestResult(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+	limit := uint32(2)
+
+	result := requestController.StartRequest(rType, limit)
+
+	assert.Equal(t, result, StartRequestResult{Started: true, Count: 1, Limit: limit})
+
+	requestController.StartRequest(rType, limit)
+
+	// No duration data yet
+
+	result = requestController.StartRequest(rType, limit)
+
+	assert.Equal(t, result, StartRequestResult{Started: false, Count: 2, Limit: limit})
+
+	// With duration data
+
+	requestController.RecordRequestDuration(rType, 3*time.Second)
+
+	assert.Equal(t, requestController.GetAverageDuration(rType), 3*time.Second)
+
+	result = requestController.StartRequest(rType, limit)
+
+	assert.False(t, result.Started)
+	assert.Equal(t, result.RetryAfter, time.Second)
+
+	requestController.RecordRequestDuration(rType, 8*time.Second)
+
+	assert.Equal(t, requestController.GetAverageDuration(rType), 4*time.Second)
+
+	// Frozen types do not estimate
+
+	requestController.Freeze(rType)
+
+	result = requestController.StartRequest(rType, limit)
+
+	assert.Equal(t, result, StartRequestResult{Started: false, Frozen: true, Count: 2, Limit: limit})
+}
+
+func TestRequestControllerForceStartRequest(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+	limit := uint32(1)
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.False(t, requestController.TryStartRequest(rType, limit))
+
+	// Forced requests ignore the limit
+
+	result := requestController.ForceStartRequest(rType, limit)
+
+	assert.Equal(t, result, StartRequestResult{Started: true, Count: 2, Limit: limit})
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(2))
+}
+
+func TestRequestControllerFailureRate(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+
+	_, ok := requestController.GetFailureRate(rType)
+
+	assert.False(t, ok)
+
+	requestController.RecordRequestOutcome(rType, false)
+
+	rate, ok := requestController.GetFailureRate(rType)
+
+	assert.True(t, ok)
+	assert.Equal(t, rate, float64(1))
+
+	for i := 0; i < 50; i++ {
+		requestController.RecordRequestOutcome(rType, true)
+	}
+
+	rate, _ = requestController.GetFailureRate(rType)
+
+	assert.Less(t, rate, 0.01)
+}
+
+func TestRequestControllerLeasePermits(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+	limit := uint32(5)
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+
+	// Only the room left is granted
+
+	result := requestController.LeasePermits(rType, limit, 10)
+
+	assert.Equal(t, result, LeasePermitsResult{Granted: 4, Count: 5, Limit: limit})
+	assert.False(t, requestController.TryStartRequest(rType, limit))
+
+	result = requestController.LeasePermits(rType, limit, 1)
+
+	assert.Equal(t, result.Granted, uint32(0))
+
+	// Returned permits release the slots
+
+	requestController.ReturnPermits(rType, 3)
+
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(2))
+
+	requestController.ReturnPermits(rType, 1)
+	requestController.EndRequest(rType)
+
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(0))
+
+	// Frozen types grant no permits
+
+	requestController.Freeze(rType)
+
+	result = requestController.LeasePermits(rType, limit, 1)
+
+	assert.Equal(t, result, LeasePermitsResult{Granted: 0, Frozen: true, Count: 0, Limit: limit})
+}
+
+func TestRequestControllerWeightedRequest(t *testing.T) {
+	requestController := CreateRequestController()
+
+	rType := "test-type"
+	limit := uint32(5)
+
+	result := requestController.StartWeightedRequest(rType, limit, 3)
+
+	assert.Equal(t, result, StartRequestResult{Started: true, Count: 3, Limit: limit})
+
+	// Not enough room for all the slots
+
+	result = requestController.StartWeightedRequest(rType, limit, 3)
+
+	assert.Equal(t, result, StartRequestResult{Started: false, Count: 3, Limit: limit})
+
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.True(t, requestController.TryStartRequest(rType, limit))
+	assert.False(t, requestController.TryStartRequest(rType, limit))
+
+	// Ending releases all the slots
+
+	requestController.EndWeightedRequest(rType, 3)
+
+	assert.Equal(t, requestController.GetRequestCount(rType), uint32(2))
+
+	// Forced requests ignore the limit
+
+	result = requestController.ForceStartWeightedRequest(rType, limit, 4)
+
+	assert.Equal(t, result, StartRequestResult{Started: true, Count: 6, Limit: limit})
+}